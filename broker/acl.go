@@ -0,0 +1,245 @@
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/amenzhinsky/mqtt"
+)
+
+// Access is a set of operations on topics.
+type Access uint8
+
+const (
+	AccessPublish Access = 1 << iota
+	AccessSubscribe
+
+	AccessAll = AccessPublish | AccessSubscribe
+)
+
+// Authorizer decides whether clients are allowed to publish to topic
+// names and subscribe to topic filters.
+//
+// Denied subscriptions get SubscriptionFailure in SUBACK and denied
+// publishes are acknowledged but dropped, wills that can't be published
+// make the broker reject connections with ConnectionNotAuthorized.
+type Authorizer interface {
+	Authorize(clientID, username string, access Access, topic string) bool
+}
+
+// AuthorizerFunc is an adapter to use functions as authorizers.
+type AuthorizerFunc func(clientID, username string, access Access, topic string) bool
+
+// Authorize implements Authorizer.
+func (fn AuthorizerFunc) Authorize(clientID, username string, access Access, topic string) bool {
+	return fn(clientID, username, access, topic)
+}
+
+// WithAuthorizer sets the authorizer, everything is allowed by default.
+func WithAuthorizer(authz Authorizer) Option {
+	return func(b *Broker) {
+		b.authz = authz
+	}
+}
+
+// Rule is an ACL entry, it applies to clients that match both
+// the username and the client id, empty ones match everything.
+// Anonymous rules apply only to clients connected without a username.
+//
+// "%c" and "%u" in the filter are replaced with the client id and the
+// username, allow rules don't apply when they are empty or contain
+// '/', '+' or '#', so clients can't gain access to other subtrees.
+type Rule struct {
+	Username  string
+	ClientID  string
+	Anonymous bool
+	Filter    string
+	Access    Access
+	Deny      bool
+}
+
+// NewACL creates an authorizer from the list of rules.
+//
+// Publishing is allowed when the topic name matches a filter of an allow
+// rule, subscribing when a filter of an allow rule matches all topics the
+// subscription does. Deny rules take precedence, they reject subscriptions
+// that match at least one topic that the rule does.
+func NewACL(rules ...Rule) *ACL {
+	return &ACL{rules: append([]Rule(nil), rules...)}
+}
+
+// ACL is an access control list.
+type ACL struct {
+	rules []Rule
+}
+
+// Authorize implements Authorizer.
+func (a *ACL) Authorize(clientID, username string, access Access, topic string) bool {
+	var allowed bool
+	for _, r := range a.rules {
+		if r.Access&access == 0 ||
+			r.Anonymous && username != "" ||
+			r.Username != "" && r.Username != username ||
+			r.ClientID != "" && r.ClientID != clientID {
+			continue
+		}
+		filter, ok := expand(r.Filter, clientID, username)
+		switch {
+		case r.Deny:
+			if access == AccessSubscribe && overlaps(filter, topic) ||
+				access == AccessPublish && mqtt.Match(filter, topic) {
+				return false
+			}
+		case ok && !allowed:
+			allowed = access == AccessSubscribe && covers(filter, topic) ||
+				access == AccessPublish && mqtt.Match(filter, topic)
+		}
+	}
+	return allowed
+}
+
+// expand substitutes "%c" and "%u" in the filter, it reports
+// whether the substituted values are safe to use in allow rules.
+func expand(filter, clientID, username string) (string, bool) {
+	ok := true
+	for _, v := range []struct {
+		placeholder, value string
+	}{
+		{"%c", clientID},
+		{"%u", username},
+	} {
+		if !strings.Contains(filter, v.placeholder) {
+			continue
+		}
+		if v.value == "" || strings.ContainsAny(v.value, "/+#") {
+			ok = false
+		}
+		filter = strings.Replace(filter, v.placeholder, v.value, -1)
+	}
+	return filter, ok
+}
+
+// covers reports whether the filter a matches all topics matched by b.
+func covers(a, b string) bool {
+	al, bl := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; ; i++ {
+		switch {
+		case i < len(al) && al[i] == "#":
+			return true
+		case i == len(al) || i == len(bl):
+			return len(al) == len(bl)
+		case al[i] == "+":
+			if bl[i] == "#" {
+				return false
+			}
+		case al[i] != bl[i]:
+			return false
+		}
+	}
+}
+
+// overlaps reports whether at least one topic is matched by both filters.
+func overlaps(a, b string) bool {
+	al, bl := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; ; i++ {
+		switch {
+		case i < len(al) && al[i] == "#", i < len(bl) && bl[i] == "#":
+			return true
+		case i == len(al) || i == len(bl):
+			return len(al) == len(bl)
+		case al[i] != "+" && bl[i] != "+" && al[i] != bl[i]:
+			return false
+		}
+	}
+}
+
+// LoadACL reads the ACL file, see ParseACL.
+func LoadACL(filename string) (*ACL, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL parses rules in the mosquitto acl_file format:
+//
+//	# topic rules before user and client lines apply
+//	# to clients connected without a username only
+//	topic read $SYS/#
+//
+//	user admin
+//	topic readwrite #
+//
+//	client dev-1
+//	topic write dev/dev-1/#
+//
+//	# pattern rules apply to everyone wherever they are
+//	pattern write dev/%c/#
+//	pattern deny dev/+/secret
+//
+// Comments and empty lines are ignored. Access is one of read (subscribe),
+// write (publish), readwrite and deny, it's readwrite when omitted.
+func ParseACL(r io.Reader) (*ACL, error) {
+	var rules []Rule
+	var username, clientID string
+	anonymous := true
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "user", "client":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("acl: line %d: %s name expected", n, fields[0])
+			}
+			if fields[0] == "user" {
+				username, clientID = fields[1], ""
+			} else {
+				username, clientID = "", fields[1]
+			}
+			anonymous = false
+		case "topic", "pattern":
+			rule := Rule{Access: AccessAll}
+			if fields[0] == "topic" {
+				rule.Username, rule.ClientID, rule.Anonymous = username, clientID, anonymous
+			}
+			switch len(fields) {
+			case 2:
+				rule.Filter = fields[1]
+			case 3:
+				switch fields[1] {
+				case "read":
+					rule.Access = AccessSubscribe
+				case "write":
+					rule.Access = AccessPublish
+				case "readwrite":
+				case "deny":
+					rule.Deny = true
+				default:
+					return nil, fmt.Errorf("acl: line %d: unknown access %q", n, fields[1])
+				}
+				rule.Filter = fields[2]
+			default:
+				return nil, fmt.Errorf("acl: line %d: malformed %s rule", n, fields[0])
+			}
+			if err := mqtt.ValidateTopicFilter(rule.Filter); err != nil {
+				return nil, fmt.Errorf("acl: line %d: %s", n, err)
+			}
+			rules = append(rules, rule)
+		default:
+			return nil, fmt.Errorf("acl: line %d: unknown keyword %q", n, fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return NewACL(rules...), nil
+}
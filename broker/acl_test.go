@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# anonymous clients
+topic read $SYS/#
+
+user admin
+topic #
+
+client monitor
+topic read dev/+/status
+
+pattern write dev/%c/#
+pattern read cmd/%u/#
+pattern deny dev/+/secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range []struct {
+		clientID, username string
+		access             Access
+		topic              string
+		want               bool
+	}{
+		{"dev-1", "", AccessPublish, "dev/dev-1/temp", true},
+		{"dev-1", "", AccessPublish, "dev/dev-2/temp", false},
+		{"dev-1", "", AccessSubscribe, "dev/dev-1/temp", false},
+		{"dev-1", "", AccessSubscribe, "$SYS/uptime", true},
+		{"dev-1", "bob", AccessSubscribe, "$SYS/uptime", false},
+		{"monitor", "", AccessSubscribe, "$SYS/uptime", true},
+		{"dev-1", "", AccessPublish, "dev/dev-1/secret", false},
+		{"dev-1", "bob", AccessSubscribe, "cmd/bob/+", true},
+		{"dev-1", "", AccessSubscribe, "cmd//#", false},
+		{"a/b", "", AccessPublish, "dev/a/b/temp", false},
+		{"+", "", AccessPublish, "dev/+/temp", false},
+		{"x", "admin", AccessSubscribe, "#", false},
+		{"x", "admin", AccessSubscribe, "dev/#", false},
+		{"x", "admin", AccessSubscribe, "dev/+/temp", true},
+		{"x", "admin", AccessPublish, "a/b", true},
+		{"monitor", "", AccessSubscribe, "dev/+/status", true},
+		{"monitor", "", AccessSubscribe, "dev/#", false},
+		{"monitor", "admin", AccessSubscribe, "dev/+/status", true},
+	} {
+		if have := acl.Authorize(run.clientID, run.username, run.access, run.topic); have != run.want {
+			t.Errorf("Authorize(%q, %q, %d, %q) = %t, want %t",
+				run.clientID, run.username, run.access, run.topic, have, run.want)
+		}
+	}
+}
+
+func TestParseACLError(t *testing.T) {
+	for _, s := range []string{
+		"topic",
+		"topic rw a",
+		"user",
+		"topic read a/#/b",
+		"deny a",
+	} {
+		if _, err := ParseACL(strings.NewReader(s)); err == nil {
+			t.Errorf("ParseACL(%q) = nil, want an error", s)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	b, addr := newBroker(t, WithAuthorizer(NewACL(
+		Rule{Filter: "dev/%c/#", Access: AccessPublish},
+		Rule{ClientID: "sub", Filter: "dev/#", Access: AccessSubscribe},
+	)))
+	defer b.Close()
+
+	pbc := make(chan *packet.Publish, 10)
+	sub := newClient(t, addr, "sub", mqtt.WithMessagesHandler(func(pk *packet.Publish) {
+		pbc <- pk
+	}))
+	defer sub.Close()
+	suback, err := sub.Subscribe(context.Background(),
+		packet.WithSubscribeTopic("dev/#", packet.QoS1),
+		packet.WithSubscribeTopic("cmd/#", packet.QoS1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint8{1, packet.SubscriptionFailure}; string(suback.ReturnCodes) != string(want) {
+		t.Fatalf("return codes = %v, want %v", suback.ReturnCodes, want)
+	}
+
+	pub := newClient(t, addr, "dev-1")
+	defer pub.Close()
+	for _, topic := range []string{"dev/dev-2/temp", "dev/dev-1/temp"} {
+		if err = pub.Publish(context.Background(), topic, packet.WithPublishQoS(packet.QoS2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pk := recv(t, pbc); pk.Topic != "dev/dev-1/temp" {
+		t.Fatalf("recv = %s, want dev/dev-1/temp", pk)
+	}
+	expectNothing(t, pbc)
+
+	// wills are checked on connect
+	conn, pk := rawConnect(t, addr, packet.NewConnect(
+		packet.WithConnectClientID("dev-2"),
+		packet.WithConnectWill("dev/dev-1/online", []byte{0}, packet.QoS1, false),
+	))
+	conn.Close()
+	if have := pk.(*packet.Connack).ReturnCode; have != packet.ConnectionNotAuthorized {
+		t.Fatalf("return code = %s, want %s", have, packet.ConnectionNotAuthorized)
+	}
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"net"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// ConnInfo describes the network connection of a client.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+
+	// PeerCertificates are certificates presented by TLS clients,
+	// they're verified when the listener requires so.
+	PeerCertificates []*x509.Certificate
+}
+
+// Authenticator decides whether clients are allowed to connect, any return
+// code except packet.ConnectionAccepted is sent in CONNACK and the connection
+// is closed afterwards.
+type Authenticator interface {
+	Authenticate(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode
+}
+
+// AuthenticatorFunc is an adapter to use functions as authenticators.
+type AuthenticatorFunc func(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode
+
+// Authenticate implements Authenticator.
+func (fn AuthenticatorFunc) Authenticate(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode {
+	return fn(connect, info)
+}
+
+// WithAuthenticator sets the authenticator, all clients are allowed by default.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(b *Broker) {
+		b.auth = auth
+	}
+}
+
+// AllowAll allows all clients to connect.
+func AllowAll() Authenticator {
+	return AuthenticatorFunc(func(*packet.Connect, ConnInfo) packet.ConnectReturnCode {
+		return packet.ConnectionAccepted
+	})
+}
+
+// NewStaticAuthenticator allows clients with usernames and passwords
+// from the map of usernames to passwords.
+func NewStaticAuthenticator(users map[string]string) Authenticator {
+	m := make(map[string]string, len(users))
+	for username, password := range users {
+		m[username] = password
+	}
+	return AuthenticatorFunc(func(connect *packet.Connect, _ ConnInfo) packet.ConnectReturnCode {
+		if connect.ConnectFlags&packet.ConnectFlagUsername == 0 {
+			return packet.ConnectionNotAuthorized
+		}
+		password, ok := m[connect.Username]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(connect.Password)) != 1 {
+			return packet.ConnectionBadUsernameOrPassword
+		}
+		return packet.ConnectionAccepted
+	})
+}
+
+// ChainAuthenticators tries authenticators in order until one of them allows
+// the client, otherwise the return code of the last one is used.
+func ChainAuthenticators(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode {
+		rc := packet.ConnectionNotAuthorized
+		for _, auth := range auths {
+			if rc = auth.Authenticate(connect, info); rc == packet.ConnectionAccepted {
+				break
+			}
+		}
+		return rc
+	})
+}
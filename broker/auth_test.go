@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestAuthenticator(t *testing.T) {
+	b, addr := newBroker(t, WithAuthenticator(ChainAuthenticators(
+		NewStaticAuthenticator(map[string]string{"user": "pass"}),
+		AuthenticatorFunc(func(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode {
+			if connect.ClientID == "guest" && info.RemoteAddr != nil {
+				return packet.ConnectionAccepted
+			}
+			return packet.ConnectionNotAuthorized
+		}),
+	)))
+	defer b.Close()
+
+	for _, run := range []struct {
+		opts []packet.ConnectOption
+		want packet.ConnectReturnCode
+	}{
+		{[]packet.ConnectOption{
+			packet.WithConnectUsername("user"),
+			packet.WithConnectPassword("pass"),
+		}, packet.ConnectionAccepted},
+		{[]packet.ConnectOption{
+			packet.WithConnectUsername("user"),
+			packet.WithConnectPassword("wrong"),
+		}, packet.ConnectionNotAuthorized},
+		{[]packet.ConnectOption{
+			packet.WithConnectClientID("guest"),
+		}, packet.ConnectionAccepted},
+		{nil, packet.ConnectionNotAuthorized},
+	} {
+		conn, pk := rawConnect(t, addr, packet.NewConnect(append([]packet.ConnectOption{
+			packet.WithConnectClientID("a"),
+		}, run.opts...)...))
+		if have := pk.(*packet.Connack).ReturnCode; have != run.want {
+			t.Errorf("return code = %s, want %s", have, run.want)
+		}
+		conn.Close()
+	}
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	auth := NewStaticAuthenticator(map[string]string{"user": "pass"})
+	for _, run := range []struct {
+		connect *packet.Connect
+		want    packet.ConnectReturnCode
+	}{
+		{packet.NewConnect(
+			packet.WithConnectUsername("user"),
+			packet.WithConnectPassword("pass"),
+		), packet.ConnectionAccepted},
+		{packet.NewConnect(
+			packet.WithConnectUsername("user"),
+		), packet.ConnectionBadUsernameOrPassword},
+		{packet.NewConnect(
+			packet.WithConnectUsername("nobody"),
+			packet.WithConnectPassword("pass"),
+		), packet.ConnectionBadUsernameOrPassword},
+		{packet.NewConnect(), packet.ConnectionNotAuthorized},
+	} {
+		if have := auth.Authenticate(run.connect, ConnInfo{}); have != run.want {
+			t.Errorf("Authenticate(%q, %q) = %s, want %s",
+				run.connect.Username, run.connect.Password, have, run.want)
+		}
+	}
+}
+
+func TestAuthenticatorPeerCertificates(t *testing.T) {
+	serverCert, clientCert := selfSigned(t, "server"), selfSigned(t, "device-1")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(WithLogger(testLogger{t}), WithAuthenticator(AuthenticatorFunc(
+		func(connect *packet.Connect, info ConnInfo) packet.ConnectReturnCode {
+			if len(info.PeerCertificates) == 0 ||
+				info.PeerCertificates[0].Subject.CommonName != connect.ClientID {
+				return packet.ConnectionNotAuthorized
+			}
+			return packet.ConnectionAccepted
+		},
+	)))
+	defer b.Close()
+	go b.Serve(l)
+
+	for id, want := range map[string]packet.ConnectReturnCode{
+		"device-1": packet.ConnectionAccepted,
+		"device-2": packet.ConnectionNotAuthorized,
+	} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = mqtt.NewEncoder(conn).Encode(packet.NewConnect(
+			packet.WithConnectClientID(id),
+		)); err != nil {
+			t.Fatal(err)
+		}
+		pk, err := mqtt.NewDecoder(conn).Decode()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := pk.(*packet.Connack).ReturnCode; have != want {
+			t.Errorf("%s: return code = %s, want %s", id, have, want)
+		}
+	}
+}
+
+func selfSigned(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,519 @@
+// Package broker implements an embeddable MQTT 3.1.1 server.
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// ErrClosed is returned by Serve after Close is called.
+var ErrClosed = errors.New("broker: closed")
+
+// Option is a broker configuration option.
+type Option func(b *Broker)
+
+// WithLogger sets the logger, by default the standard logger is used.
+func WithLogger(logger mqtt.Logger) Option {
+	return func(b *Broker) {
+		b.logger = logger
+	}
+}
+
+// WithConnectTimeout sets the time given to clients to send CONNECT
+// after connecting, it's 10 seconds by default.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(b *Broker) {
+		b.connectTimeout = d
+	}
+}
+
+// WithSessionExpiry sets the time sessions of clients connected without
+// the clean session flag are kept after they disconnect, sessions never
+// expire by default.
+func WithSessionExpiry(d time.Duration) Option {
+	return func(b *Broker) {
+		b.sessionExpiry = d
+	}
+}
+
+// WithMaxQueuedMessages limits the number of messages queued for every
+// offline client, newer messages are dropped when the limit is reached,
+// it's 1000 by default, zero disables the limit.
+func WithMaxQueuedMessages(n int) Option {
+	return func(b *Broker) {
+		b.maxQueued = n
+	}
+}
+
+// WithOutgoingQueueSize sets the number of packets buffered for sending
+// to every client, it's 64 by default.
+func WithOutgoingQueueSize(n int) Option {
+	return func(b *Broker) {
+		b.outQueueSize = n
+	}
+}
+
+// New creates a broker, it starts serving clients with Serve or ServeConn.
+func New(opts ...Option) *Broker {
+	b := &Broker{
+		logger:         &stdLogger{},
+		auth:           AllowAll(),
+		connectTimeout: 10 * time.Second,
+		maxQueued:      1000,
+		outQueueSize:   64,
+		sessions:       make(map[string]*session),
+		pending:        make(map[string]*session),
+		retained:       NewMemoryRetainedStore(),
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[*conn]struct{}),
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.sessionStore != nil {
+		b.restore()
+	}
+	return b
+}
+
+// Broker routes messages between connected clients.
+//
+// When the outgoing queue of a subscriber is full routed QoS 0 messages
+// are dropped. QoS 1 and QoS 2 messages make the publisher wait for space
+// when the subscriber has a clean session, otherwise the subscriber is
+// disconnected and receives them again when it resumes the session.
+type Broker struct {
+	logger         mqtt.Logger
+	auth           Authenticator
+	authz          Authorizer // nil allows everything
+	connectTimeout time.Duration
+	retained       RetainedStore // accessed with rmu held to order it with routing
+	sessionStore   SessionStore  // nil when sessions are not persisted
+	sessionExpiry  time.Duration
+	maxQueued      int
+	outQueueSize   int
+
+	rmu      sync.Mutex // serializes retained store updates, taken before mu
+	mu       sync.Mutex
+	sessions map[string]*session // by client id
+
+	pmu     sync.Mutex
+	pending map[string]*session // sessions to write by client id, nil ones are deleted
+	ptimer  *time.Timer         // set while a delayed write is scheduled
+	wmu     sync.Mutex          // serializes writes to the session store
+
+	lmu       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type stdLogger struct{}
+
+func (*stdLogger) Output(calldepth int, s string) error {
+	return log.Output(calldepth+1, "[broker] "+s) // +1 for this function
+}
+
+func (b *Broker) logf(format string, v ...interface{}) {
+	_ = b.logger.Output(2, fmt.Sprintf(format, v...))
+}
+
+// Serve accepts connections on the listener and serves them in
+// separate goroutines until the broker is closed or accepting fails.
+func (b *Broker) Serve(l net.Listener) error {
+	b.lmu.Lock()
+	if b.closed {
+		b.lmu.Unlock()
+		return ErrClosed
+	}
+	b.listeners[l] = struct{}{}
+	b.lmu.Unlock()
+	defer func() {
+		b.lmu.Lock()
+		delete(b.listeners, l)
+		b.lmu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+				return ErrClosed
+			default:
+				return err
+			}
+		}
+		go b.ServeConn(nc)
+	}
+}
+
+// ServeConn serves the client connection and blocks until it's closed.
+func (b *Broker) ServeConn(nc net.Conn) {
+	c := newConn(b, nc)
+	b.lmu.Lock()
+	if b.closed {
+		b.lmu.Unlock()
+		nc.Close()
+		return
+	}
+	b.conns[c] = struct{}{}
+	b.wg.Add(1)
+	b.lmu.Unlock()
+	defer func() {
+		b.lmu.Lock()
+		delete(b.conns, c)
+		b.lmu.Unlock()
+		b.wg.Done()
+	}()
+	c.serve()
+}
+
+// Close stops all listeners, closes client connections
+// and waits for them to be released.
+func (b *Broker) Close() error {
+	b.lmu.Lock()
+	if b.closed {
+		b.lmu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for l := range b.listeners {
+		l.Close()
+	}
+	for c := range b.conns {
+		c.close()
+	}
+	b.lmu.Unlock()
+	b.wg.Wait()
+
+	// offline sessions are kept in the store until they expire
+	// after the broker is started again
+	b.mu.Lock()
+	for _, s := range b.sessions {
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+	}
+	b.mu.Unlock()
+
+	b.pmu.Lock()
+	if b.ptimer != nil {
+		b.ptimer.Stop()
+		b.ptimer = nil
+	}
+	b.pmu.Unlock()
+	b.flush()
+	return nil
+}
+
+// authorize checks access of the connection to the topic.
+func (b *Broker) authorize(c *conn, access Access, topic string) bool {
+	return b.authz == nil || b.authz.Authorize(c.id, c.username, access, topic)
+}
+
+// attach binds the connection to the session with the client id, the
+// connection holding the session is closed. The existing session is resumed
+// unless either of them is clean, it reports whether the session is resumed.
+func (b *Broker) attach(c *conn, id string, clean bool) (*session, bool) {
+	b.mu.Lock()
+	s, ok := b.sessions[id]
+	if ok && (clean || s.clean) {
+		s.setOwner(nil)
+		if !s.clean {
+			b.discard(s)
+		}
+		ok = false
+	}
+	if ok {
+		if s.expiry != nil {
+			s.expiry.Stop()
+			s.expiry = nil
+		}
+		s.expiresAt = time.Time{}
+	} else {
+		s = newSession(b, id, clean)
+		b.sessions[id] = s
+	}
+	s.setOwner(c)
+	b.save(s)
+	b.mu.Unlock()
+	b.flush()
+	return s, ok
+}
+
+// detach removes the clean session or keeps the persistent one until
+// it expires, unless it's taken over by another connection.
+func (b *Broker) detach(s *session, c *conn) {
+	b.mu.Lock()
+	if b.sessions[s.id] != s || !s.owned(c) {
+		b.mu.Unlock()
+		return
+	}
+	s.setOwner(nil)
+	if s.clean {
+		delete(b.sessions, s.id)
+		b.mu.Unlock()
+		return
+	}
+	if b.sessionExpiry > 0 {
+		s.expiresAt = time.Now().Add(b.sessionExpiry)
+		s.expiry = time.AfterFunc(b.sessionExpiry, func() {
+			b.expire(s)
+		})
+	}
+	b.save(s)
+	b.mu.Unlock()
+	b.flush()
+}
+
+// expire removes the session if its client is still offline.
+func (b *Broker) expire(s *session) {
+	b.mu.Lock()
+	if b.sessions[s.id] == s && s.owned(nil) {
+		b.discard(s)
+		b.logf("%s: session expired", s.id)
+	}
+	b.mu.Unlock()
+	b.flush()
+}
+
+// discard removes the session from the broker and the store, b.mu must be held.
+func (b *Broker) discard(s *session) {
+	if b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if b.sessionStore != nil {
+		b.schedule(s.id, nil)
+	}
+}
+
+// persistDelay is the time writes of sessions of offline clients are delayed
+// for, so messages queued meanwhile are written to the store at once.
+const persistDelay = 100 * time.Millisecond
+
+// persist saves the persistent session of an offline client after a delay.
+func (b *Broker) persist(s *session) {
+	b.mu.Lock()
+	if b.sessions[s.id] == s && s.owned(nil) {
+		b.save(s)
+	}
+	b.mu.Unlock()
+
+	b.pmu.Lock()
+	defer b.pmu.Unlock()
+	select {
+	case <-b.done:
+		return // Close writes pending sessions
+	default:
+	}
+	if b.ptimer == nil {
+		b.ptimer = time.AfterFunc(persistDelay, func() {
+			b.pmu.Lock()
+			b.ptimer = nil
+			b.pmu.Unlock()
+			b.flush()
+		})
+	}
+}
+
+// save schedules writing of the persistent session, it's written by
+// the next flush, b.mu must be held.
+func (b *Broker) save(s *session) {
+	if b.sessionStore == nil || s.clean {
+		return
+	}
+	b.schedule(s.id, s)
+}
+
+// schedule records the session to be written or deleted when it's nil,
+// only the latest change of every client id is kept.
+func (b *Broker) schedule(id string, s *session) {
+	b.pmu.Lock()
+	b.pending[id] = s
+	b.pmu.Unlock()
+}
+
+// flush writes scheduled changes to the session store, when it returns
+// changes scheduled before the call are written, b.mu must not be held,
+// so routing doesn't wait for I/O.
+func (b *Broker) flush() {
+	if b.sessionStore == nil {
+		return
+	}
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	b.pmu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]*session)
+	b.pmu.Unlock()
+
+	for id, s := range pending {
+		if s == nil {
+			if err := b.sessionStore.Delete(id); err != nil {
+				b.logf("%s: deleting session: %s", id, err)
+			}
+			continue
+		}
+
+		// snapshots are taken right before writing to catch up with
+		// changes made since the session was scheduled
+		var st *SessionState
+		b.mu.Lock()
+		if b.sessions[id] == s {
+			st = s.state()
+			st.ExpiresAt = s.expiresAt
+		}
+		b.mu.Unlock()
+		if st == nil {
+			continue // discarded, its deletion is scheduled
+		}
+		if err := b.sessionStore.Save(st); err != nil {
+			b.logf("%s: saving session: %s", id, err)
+		}
+	}
+}
+
+// restore loads persistent sessions from the store, their clients are
+// offline, so they expire unless the clients connect in time.
+func (b *Broker) restore() {
+	states, err := b.sessionStore.Load()
+	if err != nil {
+		b.logf("loading sessions: %s", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, st := range states {
+		s := restoreSession(b, st)
+		b.sessions[s.id] = s
+		if b.sessionExpiry <= 0 {
+			continue
+		}
+		s.expiresAt = st.ExpiresAt
+		if s.expiresAt.IsZero() {
+			// the broker stopped while the client was connected
+			s.expiresAt = time.Now().Add(b.sessionExpiry)
+		}
+		s.expiry = time.AfterFunc(time.Until(s.expiresAt), func() {
+			b.expire(s)
+		})
+	}
+}
+
+// delivery is a message to be sent to a session.
+type delivery struct {
+	s   *session
+	pk  *packet.Publish
+	qos packet.QoS
+}
+
+// publish stores the retained message and delivers it to all matching
+// subscriptions, the packet must not be modified afterwards.
+func (b *Broker) publish(pk *packet.Publish) {
+	var deliveries []delivery
+	retain := enabled(pk.Flags, packet.PublishRetain)
+	if retain {
+		// the store may do I/O, so routing of other messages doesn't wait
+		// for it, only subscribing does, that makes new subscriptions get
+		// the message either as retained or routed but never both
+		b.rmu.Lock()
+		// a zero-length payload clears the retained message
+		var err error
+		if len(pk.Payload) == 0 {
+			err = b.retained.Delete(pk.Topic)
+		} else {
+			err = b.retained.Put(pk)
+		}
+		if err != nil {
+			b.logf("retain %s: %s", pk.Topic, err)
+		}
+	}
+	b.mu.Lock()
+	for _, s := range b.sessions {
+		if qos, ok := s.match(pk.Topic); ok {
+			deliveries = append(deliveries, delivery{s, pk, minQoS(qosOf(pk), qos)})
+		}
+	}
+	b.mu.Unlock()
+	if retain {
+		b.rmu.Unlock()
+	}
+
+	for _, d := range deliveries {
+		d.s.deliver(d.pk, d.qos, false)
+	}
+}
+
+// subscribe adds subscriptions to the session and returns retained messages
+// matching them, they are supposed to be delivered after SUBACK.
+func (b *Broker) subscribe(s *session, topics []*packet.SubscribeTopic, granted []uint8) []delivery {
+	var retained []delivery
+	b.rmu.Lock()
+	b.mu.Lock()
+	for i, topic := range topics {
+		if granted[i] == packet.SubscriptionFailure {
+			continue
+		}
+		s.subscribe(topic.Name, packet.QoS(granted[i]))
+		pks, err := b.retained.Match(topic.Name)
+		if err != nil {
+			b.logf("retained %s: %s", topic.Name, err)
+		}
+		for _, pk := range pks {
+			retained = append(retained, delivery{s, pk, minQoS(qosOf(pk), packet.QoS(granted[i]))})
+		}
+	}
+	b.save(s)
+	b.mu.Unlock()
+	b.rmu.Unlock()
+	b.flush()
+	return retained
+}
+
+func (b *Broker) unsubscribe(s *session, filters []string) {
+	b.mu.Lock()
+	for _, filter := range filters {
+		s.unsubscribe(filter)
+	}
+	b.save(s)
+	b.mu.Unlock()
+	b.flush()
+}
+
+func enabled(flags packet.Flags, flag uint8) bool {
+	return uint8(flags)&flag != 0
+}
+
+func qosOf(pk *packet.Publish) packet.QoS {
+	switch {
+	case enabled(pk.Flags, packet.PublishQoS2):
+		return packet.QoS2
+	case enabled(pk.Flags, packet.PublishQoS1):
+		return packet.QoS1
+	default:
+		return packet.QoS0
+	}
+}
+
+func minQoS(a, b packet.QoS) packet.QoS {
+	if a < b {
+		return a
+	}
+	return b
+}
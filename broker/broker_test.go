@@ -0,0 +1,386 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestPubSub(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	pbc := make(chan *packet.Publish, 10)
+	sub := newClient(t, addr, "sub", mqtt.WithMessagesHandler(func(pk *packet.Publish) {
+		pbc <- pk
+	}))
+	defer sub.Close()
+	suback, err := sub.Subscribe(context.Background(),
+		packet.WithSubscribeTopic("a/+/c", packet.QoS1),
+		packet.WithSubscribeTopic("a/#", packet.QoS2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint8{1, 2}; string(suback.ReturnCodes) != string(want) {
+		t.Fatalf("return codes = %v, want %v", suback.ReturnCodes, want)
+	}
+
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+	for _, qos := range []packet.QoS{packet.QoS0, packet.QoS1, packet.QoS2} {
+		if err = pub.Publish(context.Background(), "a/b/c",
+			packet.WithPublishQoS(qos),
+			packet.WithPublishPayload([]byte{byte(qos)}),
+		); err != nil {
+			t.Fatal(err)
+		}
+		// overlapping subscriptions deliver a message once with the maximum QoS
+		pk := recv(t, pbc)
+		if pk.Topic != "a/b/c" || pk.Payload[0] != byte(qos) || qosOf(pk) != qos {
+			t.Fatalf("recv = %s, want QoS %d", pk, qos)
+		}
+	}
+	if err = pub.Publish(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sub.Unsubscribe(context.Background(),
+		packet.WithUnsubscribeTopic("a/+/c", "a/#"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Publish(context.Background(), "a/b/c", packet.WithPublishQoS(packet.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, pbc)
+}
+
+func TestRetained(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+	for _, topic := range []string{"a/1", "a/2"} {
+		if err := pub.Publish(context.Background(), topic,
+			packet.WithPublishQoS(packet.QoS1),
+			packet.WithPublishRetain(true),
+			packet.WithPublishPayload([]byte(topic)),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a zero-length payload clears the retained message
+	if err := pub.Publish(context.Background(), "a/2",
+		packet.WithPublishQoS(packet.QoS1),
+		packet.WithPublishRetain(true),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	pbc := make(chan *packet.Publish, 10)
+	sub := newClient(t, addr, "sub", mqtt.WithMessagesHandler(func(pk *packet.Publish) {
+		pbc <- pk
+	}))
+	defer sub.Close()
+	if _, err := sub.Subscribe(context.Background(),
+		packet.WithSubscribeTopic("a/+", packet.QoS0),
+	); err != nil {
+		t.Fatal(err)
+	}
+	pk := recv(t, pbc)
+	if pk.Topic != "a/1" || !enabled(pk.Flags, packet.PublishRetain) || qosOf(pk) != packet.QoS0 {
+		t.Fatalf("recv = %s, want retained a/1 with QoS 0", pk)
+	}
+	expectNothing(t, pbc)
+}
+
+func TestWill(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	pbc := make(chan *packet.Publish, 10)
+	sub := newClient(t, addr, "sub", mqtt.WithMessagesHandler(func(pk *packet.Publish) {
+		pbc <- pk
+	}))
+	defer sub.Close()
+	if _, err := sub.Subscribe(context.Background(),
+		packet.WithSubscribeTopic("will/#", packet.QoS1),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// the will is discarded on DISCONNECT
+	c := newClient(t, addr, "a", packet.WithConnectWill("will/a", []byte("a"), packet.QoS1, false))
+	if err := c.Disconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, pbc)
+
+	c = newClient(t, addr, "b", packet.WithConnectWill("will/b", []byte("b"), packet.QoS1, false))
+	c.Close()
+	if pk := recv(t, pbc); pk.Topic != "will/b" || string(pk.Payload) != "b" {
+		t.Fatalf("recv = %s, want will/b", pk)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	conn, pk := rawConnect(t, addr, packet.NewConnect(
+		packet.WithConnectClientID("a"),
+		packet.WithConnectKeepAlive(1),
+	))
+	defer conn.Close()
+	if connack := pk.(*packet.Connack); connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("return code = %s", connack.ReturnCode)
+	}
+
+	// the connection is closed after one and a half keep-alive periods
+	start := time.Now()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+	if d := time.Since(start); d < time.Second || d > 3*time.Second {
+		t.Fatalf("connection is closed after %s", d)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	conn, _ := rawConnect(t, addr, packet.NewConnect(packet.WithConnectClientID("a")))
+	defer conn.Close()
+	c := newClient(t, addr, "a")
+	defer c.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	for _, run := range []struct {
+		connect *packet.Connect
+		want    packet.ConnectReturnCode
+	}{
+		{packet.NewConnect(packet.WithConnectProtocolLevel(3)), packet.ConnectionUnacceptableProtocolVersion},
+		{packet.NewConnect(), packet.ConnectionIdentifierRejected},
+		{packet.NewConnect(packet.WithConnectCleanSession(true)), packet.ConnectionAccepted},
+	} {
+		conn, pk := rawConnect(t, addr, run.connect)
+		conn.Close()
+		if have := pk.(*packet.Connack).ReturnCode; have != run.want {
+			t.Errorf("return code = %s, want %s", have, run.want)
+		}
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	b, addr := newBroker(t)
+	defer b.Close()
+
+	// the subscriber doesn't read anything, that fills up socket buffers
+	// and the outgoing queue, but the publisher is not blocked
+	conn, dec := slowSubscriber(t, addr, false, packet.QoS1)
+	defer conn.Close()
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+	if err := flood(pub, packet.QoS1, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the subscriber of a persistent session is disconnected
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := dec.Decode(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("subscriber is not disconnected")
+			}
+			return
+		}
+	}
+}
+
+func TestSlowSubscriberQoS0(t *testing.T) {
+	b, addr := newBroker(t, WithOutgoingQueueSize(1))
+	defer b.Close()
+
+	conn, dec := slowSubscriber(t, addr, true, packet.QoS0)
+	defer conn.Close()
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+	if err := flood(pub, packet.QoS1, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages are dropped but the subscriber stays connected
+	if err := mqtt.NewEncoder(conn).Encode(packet.NewPingreq()); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, ok := sessionRecv(t, conn, dec).(*packet.Pingresp); ok {
+			return
+		}
+	}
+}
+
+func TestSlowSubscriberBackpressure(t *testing.T) {
+	b, addr := newBroker(t, WithOutgoingQueueSize(1))
+	defer b.Close()
+
+	conn, dec := slowSubscriber(t, addr, true, packet.QoS1)
+	defer conn.Close()
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+
+	// messages to the clean session are not dropped, so the publisher waits
+	if err := flood(pub, packet.QoS1, time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, ok := sessionRecv(t, conn, dec).(*packet.Publish); !ok {
+		t.Fatal("publish expected")
+	}
+}
+
+// slowSubscriber subscribes to "a" with a raw connection that isn't read afterwards.
+func slowSubscriber(t *testing.T, addr string, clean bool, qos packet.QoS) (net.Conn, *mqtt.Decoder) {
+	t.Helper()
+	conn, dec, _ := sessionConnect(t, addr, "slow", clean)
+	if err := mqtt.NewEncoder(conn).Encode(packet.NewSubscribe(
+		packet.WithSubscribePacketID(1),
+		packet.WithSubscribeTopic("a", qos),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sessionRecv(t, conn, dec).(*packet.Suback); !ok {
+		t.Fatal("suback expected")
+	}
+	return conn, dec
+}
+
+// flood publishes more than socket buffers can hold to "a".
+func flood(c *mqtt.Client, qos packet.QoS, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	payload := make([]byte, 64<<10)
+	for i := 0; i < 512; i++ {
+		if err := c.Publish(ctx, "a",
+			packet.WithPublishQoS(qos),
+			packet.WithPublishPayload(payload),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newBroker(t *testing.T, opts ...Option) (*Broker, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := New(append([]Option{WithLogger(testLogger{t})}, opts...)...)
+	go b.Serve(l)
+	return b, l.Addr().String()
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Output(calldepth int, s string) error {
+	l.t.Log(s)
+	return nil
+}
+
+// newClient connects to the broker with a clean session,
+// options are either mqtt.Option or packet.ConnectOption.
+func newClient(t *testing.T, addr, id string, opts ...interface{}) *mqtt.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copts []packet.ConnectOption
+	var mopts []mqtt.Option
+	for _, opt := range opts {
+		switch v := opt.(type) {
+		case mqtt.Option:
+			mopts = append(mopts, v)
+		case packet.ConnectOption:
+			copts = append(copts, v)
+		default:
+			t.Fatalf("unexpected option %T", opt)
+		}
+	}
+	c := mqtt.New(conn, mopts...)
+	if _, err = c.Connect(context.Background(), append([]packet.ConnectOption{
+		packet.WithConnectClientID(id),
+		packet.WithConnectCleanSession(true),
+	}, copts...)...); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// rawConnect sends CONNECT and returns the connection and the response.
+func rawConnect(t *testing.T, addr string, connect *packet.Connect) (net.Conn, packet.IncomingPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mqtt.NewEncoder(conn).Encode(connect); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := mqtt.NewDecoder(conn).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, pk
+}
+
+func recv(t *testing.T, pbc <-chan *packet.Publish) *packet.Publish {
+	t.Helper()
+	select {
+	case pk := <-pbc:
+		return pk
+	case <-time.After(5 * time.Second):
+		t.Fatal("recv timed out")
+		return nil
+	}
+}
+
+func expectNothing(t *testing.T, pbc <-chan *packet.Publish) {
+	t.Helper()
+	select {
+	case pk := <-pbc:
+		t.Fatalf("unexpected delivery: %s", pk)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,326 @@
+package broker
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func newConn(b *Broker, nc net.Conn) *conn {
+	return &conn{
+		b:    b,
+		nc:   nc,
+		enc:  mqtt.NewEncoder(nc),
+		dec:  mqtt.NewServerDecoder(nc),
+		out:  make(chan packet.OutgoingPacket, b.outQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// conn is a client network connection.
+type conn struct {
+	b   *Broker
+	nc  net.Conn
+	enc *mqtt.Encoder // used by the tx goroutine only after CONNACK
+	dec *mqtt.Decoder
+
+	out  chan packet.OutgoingPacket
+	done chan struct{}
+	once sync.Once
+
+	id        string // client id
+	username  string
+	session   *session
+	will      *packet.Publish // cleared on DISCONNECT
+	keepAlive time.Duration
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	if err := c.connect(); err != nil {
+		c.b.logf("%s: connect failed: %s", c.nc.RemoteAddr(), err)
+		return
+	}
+	go c.tx()
+
+	c.session.resume(c)
+	err := c.rx()
+	c.b.detach(c.session, c)
+	if c.will != nil {
+		c.b.publish(c.will)
+	}
+	if err != nil && err != io.EOF {
+		select {
+		case <-c.done: // closed by the broker or taken over
+		default:
+			c.b.logf("%s: connection lost: %s", c.id, err)
+		}
+	}
+}
+
+// connect handles CONNECT and responds with CONNACK.
+func (c *conn) connect() error {
+	if c.b.connectTimeout > 0 {
+		if err := c.nc.SetReadDeadline(time.Now().Add(c.b.connectTimeout)); err != nil {
+			return err
+		}
+	}
+	pk, err := c.dec.Decode()
+	if err != nil {
+		return err
+	}
+	connect, ok := pk.(*packet.Connect)
+	if !ok {
+		return fmt.Errorf("protocol violation: connect expected, got %s", pk)
+	}
+	if connect.ProtocolName != packet.ProtocolName || connect.ProtocolLevel != packet.ProtocolLevel311 {
+		_ = c.reject(packet.ConnectionUnacceptableProtocolVersion)
+		return fmt.Errorf("unsupported protocol %s %d", connect.ProtocolName, connect.ProtocolLevel)
+	}
+	if connect.ConnectFlags&0x01 != 0 {
+		return errors.New("protocol violation: reserved connect flag is set")
+	}
+
+	cleanSession := connect.ConnectFlags&packet.ConnectFlagCleanSession != 0
+	c.id = connect.ClientID
+	if c.id == "" {
+		if !cleanSession {
+			_ = c.reject(packet.ConnectionIdentifierRejected)
+			return errors.New("empty client id without clean session")
+		}
+		if c.id, err = generateID(); err != nil {
+			return err
+		}
+	}
+	if c.will, err = will(connect); err != nil {
+		return err
+	}
+	if rc := c.b.auth.Authenticate(connect, c.info()); rc != packet.ConnectionAccepted {
+		_ = c.reject(rc)
+		return fmt.Errorf("%s: %s", c.id, rc)
+	}
+	c.username = connect.Username
+	if c.will != nil && !c.b.authorize(c, AccessPublish, c.will.Topic) {
+		_ = c.reject(packet.ConnectionNotAuthorized)
+		return fmt.Errorf("%s: will topic %s is not allowed", c.id, c.will.Topic)
+	}
+
+	var present bool
+	c.session, present = c.b.attach(c, c.id, cleanSession)
+	c.keepAlive = time.Duration(connect.KeepAlive) * time.Second
+	if err = c.enc.Encode(packet.NewConnack(
+		packet.WithConnackSessionPresent(present),
+	)); err != nil {
+		c.b.detach(c.session, c)
+		return err
+	}
+	return nil
+}
+
+// info returns the connection metadata, the TLS handshake
+// is complete at this point since CONNECT is received.
+func (c *conn) info() ConnInfo {
+	info := ConnInfo{RemoteAddr: c.nc.RemoteAddr()}
+	if tc, ok := c.nc.(*tls.Conn); ok {
+		info.PeerCertificates = tc.ConnectionState().PeerCertificates
+	}
+	return info
+}
+
+func (c *conn) reject(rc packet.ConnectReturnCode) error {
+	return c.enc.Encode(packet.NewConnack(packet.WithConnackReturnCode(rc)))
+}
+
+// will returns the will message of the client if it's set.
+func will(connect *packet.Connect) (*packet.Publish, error) {
+	flags := connect.ConnectFlags
+	if flags&packet.ConnectFlagWillFlag == 0 {
+		if flags&(packet.ConnectFlagWillQoS1|packet.ConnectFlagWillQoS2|packet.ConnectFlagWillRetain) != 0 {
+			return nil, errors.New("protocol violation: will flags are set without will")
+		}
+		return nil, nil
+	}
+	var qos packet.QoS
+	switch flags & (packet.ConnectFlagWillQoS1 | packet.ConnectFlagWillQoS2) {
+	case 0:
+	case packet.ConnectFlagWillQoS1:
+		qos = packet.QoS1
+	case packet.ConnectFlagWillQoS2:
+		qos = packet.QoS2
+	default:
+		return nil, errors.New("protocol violation: invalid will QoS")
+	}
+	if err := mqtt.ValidateTopicName(connect.WillTopic); err != nil {
+		return nil, fmt.Errorf("protocol violation: %s", err)
+	}
+	return packet.NewPublish(connect.WillTopic,
+		packet.WithPublishQoS(qos),
+		packet.WithPublishRetain(flags&packet.ConnectFlagWillRetain != 0),
+		packet.WithPublishPayload(connect.WillPayload),
+	), nil
+}
+
+func generateID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return "auto-" + hex.EncodeToString(b), nil
+}
+
+// rx reads packets until the connection is closed or DISCONNECT is received.
+func (c *conn) rx() error {
+	for {
+		// clients have one and a half keep-alive periods to send a packet
+		var deadline time.Time
+		if c.keepAlive > 0 {
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		if err := c.nc.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+		pk, err := c.dec.Decode()
+		if err != nil {
+			return err
+		}
+		switch v := pk.(type) {
+		case *packet.Publish:
+			err = c.handlePublish(v)
+		case *packet.Puback:
+			c.session.acknowledge(v.PacketID)
+		case *packet.Pubrec:
+			c.session.release(v.PacketID)
+			c.send(packet.NewPubrel(v.PacketID))
+		case *packet.Pubrel:
+			c.session.complete(v.PacketID)
+			c.send(packet.NewPubcomp(v.PacketID))
+		case *packet.Pubcomp:
+			c.session.acknowledge(v.PacketID)
+		case *packet.Subscribe:
+			err = c.handleSubscribe(v)
+		case *packet.Unsubscribe:
+			c.b.unsubscribe(c.session, v.Topics)
+			c.send(packet.NewUnsuback(v.PacketID))
+		case *packet.Pingreq:
+			c.send(packet.NewPingresp())
+		case *packet.Disconnect:
+			c.will = nil
+			return nil
+		default:
+			err = fmt.Errorf("protocol violation: unexpected %s", pk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) handlePublish(pk *packet.Publish) error {
+	if enabled(pk.Flags, packet.PublishQoS1) && enabled(pk.Flags, packet.PublishQoS2) {
+		return errors.New("protocol violation: invalid QoS")
+	}
+	if err := mqtt.ValidateTopicName(pk.Topic); err != nil {
+		return fmt.Errorf("protocol violation: %s", err)
+	}
+
+	// denied messages are acknowledged as usual, MQTT 3.1.1 can't report errors
+	publish := func() {}
+	if c.b.authorize(c, AccessPublish, pk.Topic) {
+		// the payload is reused by the decoder
+		cp := *pk
+		cp.Payload = append([]byte(nil), pk.Payload...)
+		publish = func() { c.b.publish(&cp) }
+	} else {
+		c.b.logf("%s: publish to %s denied", c.id, pk.Topic)
+	}
+	switch qosOf(pk) {
+	case packet.QoS0:
+		publish()
+	case packet.QoS1:
+		publish()
+		c.send(packet.NewPuback(pk.PacketID))
+	case packet.QoS2:
+		// duplicates are not delivered until the packet id is released
+		if c.session.receive(pk.PacketID) {
+			publish()
+		}
+		c.send(packet.NewPubrec(pk.PacketID))
+	}
+	return nil
+}
+
+func (c *conn) handleSubscribe(pk *packet.Subscribe) error {
+	granted := make([]uint8, len(pk.Topics))
+	for i, topic := range pk.Topics {
+		if topic.Flags > packet.QoS2 {
+			return fmt.Errorf("protocol violation: invalid subscription options %#x", topic.Flags)
+		}
+		if err := mqtt.ValidateTopicFilter(topic.Name); err != nil {
+			c.b.logf("%s: %s", c.id, err)
+			granted[i] = packet.SubscriptionFailure
+			continue
+		}
+		if !c.b.authorize(c, AccessSubscribe, topic.Name) {
+			c.b.logf("%s: subscription to %s denied", c.id, topic.Name)
+			granted[i] = packet.SubscriptionFailure
+			continue
+		}
+		granted[i] = topic.Flags
+	}
+	retained := c.b.subscribe(c.session, pk.Topics, granted)
+	c.send(packet.NewSuback(pk.PacketID, packet.WithSubackReturnCodes(granted...)))
+	for _, d := range retained {
+		d.s.deliver(d.pk, d.qos, true)
+	}
+	return nil
+}
+
+// send queues the packet for sending, it's discarded when the connection is closed.
+func (c *conn) send(pk packet.OutgoingPacket) {
+	select {
+	case c.out <- pk:
+	case <-c.done:
+	}
+}
+
+// offer queues the packet without waiting for space, it reports false
+// when the queue is full, so the caller decides what to do with it.
+func (c *conn) offer(pk packet.OutgoingPacket) bool {
+	select {
+	case c.out <- pk:
+	case <-c.done:
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *conn) tx() {
+	for {
+		select {
+		case pk := <-c.out:
+			if err := c.enc.Encode(pk); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.nc.Close()
+	})
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/internal/atomicfile"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// NewFileRetainedStore creates a store that keeps every retained message
+// in a separate file in the given directory and an index of them in memory,
+// files are replaced atomically so the store survives crashes and restarts.
+func NewFileRetainedStore(dir string) (RetainedStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &fileRetained{dir: dir, index: NewMemoryRetainedStore()}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), fileRetainedPrefix) || strings.HasSuffix(fi.Name(), atomicfile.TmpSuffix) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		pk, err := mqtt.NewServerDecoder(bytes.NewReader(b)).Decode()
+		if err != nil {
+			return nil, fmt.Errorf("corrupted file %q: %s", fi.Name(), err)
+		}
+		pb, ok := pk.(*packet.Publish)
+		if !ok {
+			return nil, fmt.Errorf("corrupted file %q: unexpected %s", fi.Name(), pk)
+		}
+		if err = s.index.Put(pb); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type fileRetained struct {
+	mu    sync.Mutex
+	dir   string
+	index RetainedStore
+}
+
+const fileRetainedPrefix = "retained-"
+
+// name returns the file name of the topic, topics are hashed
+// because they may contain any characters and be too long.
+func (s *fileRetained) name(topic string) string {
+	sum := sha256.Sum256([]byte(topic))
+	return filepath.Join(s.dir, fileRetainedPrefix+hex.EncodeToString(sum[:]))
+}
+
+func (s *fileRetained) Put(pk *packet.Publish) error {
+	var buf bytes.Buffer
+	if err := mqtt.NewEncoder(&buf).Encode(pk); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := atomicfile.Write(s.name(pk.Topic), buf.Bytes()); err != nil {
+		return err
+	}
+	return s.index.Put(pk)
+}
+
+func (s *fileRetained) Delete(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.name(topic)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.index.Delete(topic)
+}
+
+func (s *fileRetained) Match(filter string) ([]*packet.Publish, error) {
+	return s.index.Match(filter)
+}
@@ -0,0 +1,130 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// RetainedStore keeps the last retained message of every topic.
+//
+// Implementations have to be safe for concurrent use, the broker
+// doesn't modify stored packets and neither should implementations.
+type RetainedStore interface {
+	// Put stores the message replacing the one with the same topic.
+	Put(pk *packet.Publish) error
+
+	// Delete removes the message, it's not an error if it doesn't exist.
+	Delete(topic string) error
+
+	// Match returns messages with topics matching the filter.
+	Match(filter string) ([]*packet.Publish, error)
+}
+
+// WithRetainedStore sets the store for retained messages,
+// they're kept in memory by default that doesn't survive restarts.
+func WithRetainedStore(store RetainedStore) Option {
+	return func(b *Broker) {
+		b.retained = store
+	}
+}
+
+// NewMemoryRetainedStore creates a store that keeps retained messages in
+// a tree of topic levels, so wildcard filters only visit matching branches.
+func NewMemoryRetainedStore() RetainedStore {
+	return &memoryRetained{root: &retainedNode{}}
+}
+
+type memoryRetained struct {
+	mu   sync.RWMutex
+	root *retainedNode
+}
+
+type retainedNode struct {
+	children map[string]*retainedNode
+	pk       *packet.Publish
+}
+
+func (s *memoryRetained) Put(pk *packet.Publish) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.root
+	for _, level := range strings.Split(pk.Topic, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*retainedNode)
+			}
+			child = &retainedNode{}
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.pk = pk
+	return nil
+}
+
+func (s *memoryRetained) Delete(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root.delete(strings.Split(topic, "/"))
+	return nil
+}
+
+// delete removes the message and prunes nodes left empty,
+// it reports whether the node itself has become empty.
+func (n *retainedNode) delete(levels []string) bool {
+	if len(levels) == 0 {
+		n.pk = nil
+	} else if child, ok := n.children[levels[0]]; ok && child.delete(levels[1:]) {
+		delete(n.children, levels[0])
+	}
+	return n.pk == nil && len(n.children) == 0
+}
+
+func (s *memoryRetained) Match(filter string) ([]*packet.Publish, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var pks []*packet.Publish
+	s.root.match(strings.Split(filter, "/"), true, &pks)
+	return pks, nil
+}
+
+// match collects messages matching the filter levels, wildcards
+// on the first level don't match topics starting with '$'.
+func (n *retainedNode) match(levels []string, first bool, pks *[]*packet.Publish) {
+	if len(levels) == 0 {
+		if n.pk != nil {
+			*pks = append(*pks, n.pk)
+		}
+		return
+	}
+	switch levels[0] {
+	case "#":
+		// "a/#" matches "a" too
+		n.all(first, pks)
+	case "+":
+		for level, child := range n.children {
+			if !first || !strings.HasPrefix(level, "$") {
+				child.match(levels[1:], false, pks)
+			}
+		}
+	default:
+		if child, ok := n.children[levels[0]]; ok {
+			child.match(levels[1:], false, pks)
+		}
+	}
+}
+
+// all collects messages of the node and all of its descendants.
+func (n *retainedNode) all(first bool, pks *[]*packet.Publish) {
+	if n.pk != nil {
+		*pks = append(*pks, n.pk)
+	}
+	for level, child := range n.children {
+		if !first || !strings.HasPrefix(level, "$") {
+			child.all(false, pks)
+		}
+	}
+}
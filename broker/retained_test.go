@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestRetainedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-retained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, mk := range map[string]func() (RetainedStore, error){
+		"memory": func() (RetainedStore, error) {
+			return NewMemoryRetainedStore(), nil
+		},
+		"file": func() (RetainedStore, error) {
+			return NewFileRetainedStore(dir)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := mk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, topic := range []string{"a", "a/b", "a/b/c", "a/c", "b", "$SYS/uptime"} {
+				if err = s.Put(packet.NewPublish(topic,
+					packet.WithPublishQoS(packet.QoS1),
+					packet.WithPublishPacketID(1),
+					packet.WithPublishRetain(true),
+					packet.WithPublishPayload([]byte(topic)),
+				)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = s.Delete("a/c"); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Delete("x/y"); err != nil {
+				t.Fatal(err)
+			}
+			testRetainedMatch(t, s)
+
+			if name == "file" {
+				if s, err = NewFileRetainedStore(dir); err != nil {
+					t.Fatal(err)
+				}
+				testRetainedMatch(t, s)
+			}
+		})
+	}
+}
+
+func testRetainedMatch(t *testing.T, s RetainedStore) {
+	t.Helper()
+	for filter, want := range map[string]string{
+		"#":         "a a/b a/b/c b",
+		"a/#":       "a a/b a/b/c",
+		"+":         "a b",
+		"+/+":       "a/b",
+		"a/+/c":     "a/b/c",
+		"a/c":       "",
+		"$SYS/#":    "$SYS/uptime",
+		"+/uptime":  "",
+		"a/b/c/d/#": "",
+	} {
+		pks, err := s.Match(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topics := make([]string, 0, len(pks))
+		for _, pk := range pks {
+			if string(pk.Payload) != pk.Topic {
+				t.Errorf("%s: payload = %q, want %q", filter, pk.Payload, pk.Topic)
+			}
+			topics = append(topics, pk.Topic)
+		}
+		sort.Strings(topics)
+		if have := strings.Join(topics, " "); have != want {
+			t.Errorf("Match(%q) = %q, want %q", filter, have, want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func newSession(b *Broker, id string, clean bool) *session {
+	return &session{
+		b:        b,
+		id:       id,
+		clean:    clean,
+		subs:     make(map[string]packet.QoS),
+		inflight: make(map[uint16]*packet.Publish),
+		released: make(map[uint16]struct{}),
+		inbound:  make(map[uint16]struct{}),
+	}
+}
+
+// session is the client state identified by its client id.
+type session struct {
+	b     *Broker
+	id    string
+	clean bool // discarded on disconnect
+
+	// guarded by Broker.mu
+	subs      map[string]packet.QoS // topic filters to granted QoS
+	expiry    *time.Timer           // set while the client of a persistent session is offline
+	expiresAt time.Time
+
+	mu       sync.Mutex
+	owner    *conn // nil when the client is offline
+	conn     *conn // the owner when it's ready to receive messages
+	nextID   uint16
+	inflight map[uint16]*packet.Publish // outgoing QoS 1 and 2 messages not acknowledged
+	order    []uint16                   // inflight packet ids in the order messages are sent
+	released map[uint16]struct{}        // outgoing QoS 2 messages PUBREC is received for
+	queue    []*packet.Publish          // messages waiting for the client
+	inbound  map[uint16]struct{}        // incoming QoS 2 packet ids not released
+}
+
+// setOwner binds the session to the connection, the previous one is closed,
+// messages are queued until the session is resumed by the connection.
+func (s *session) setOwner(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != nil && s.owner != c {
+		s.owner.close()
+	}
+	s.owner = c
+	s.conn = nil
+}
+
+// owned reports whether the connection owns the session.
+func (s *session) owned(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owner == c
+}
+
+// resume resends messages that are not acknowledged on previous connections
+// and sends queued ones, messages routed to the session meanwhile are queued
+// too, so they are delivered in order.
+func (s *session) resume(c *conn) {
+	s.mu.Lock()
+	pks := make([]packet.OutgoingPacket, 0, len(s.order))
+	for _, id := range s.order {
+		if _, ok := s.released[id]; ok {
+			pks = append(pks, packet.NewPubrel(id))
+			continue
+		}
+		// the packet may still be encoded by the previous connection
+		dup := *s.inflight[id]
+		dup.Flags |= packet.PublishDup
+		s.inflight[id] = &dup
+		pks = append(pks, &dup)
+	}
+	for {
+		s.mu.Unlock()
+		for _, pk := range pks {
+			c.send(pk)
+		}
+		pks = pks[:0]
+
+		s.mu.Lock()
+		if s.owner != c {
+			break // taken over
+		}
+		if len(s.queue) == 0 {
+			s.conn = c
+			break
+		}
+		for _, pk := range s.queue {
+			// queued packets may be referenced by session snapshots
+			cp := *pk
+			if qosOf(&cp) != packet.QoS0 && !s.track(&cp) {
+				continue
+			}
+			pks = append(pks, &cp)
+		}
+		s.queue = nil
+	}
+	s.mu.Unlock()
+}
+
+func (s *session) subscribe(filter string, qos packet.QoS) {
+	s.subs[filter] = qos
+}
+
+func (s *session) unsubscribe(filter string) {
+	delete(s.subs, filter)
+}
+
+// match returns the maximum QoS granted to subscriptions that match the
+// topic, so overlapping subscriptions deliver a message only once.
+func (s *session) match(topic string) (packet.QoS, bool) {
+	var max packet.QoS
+	var ok bool
+	for filter, qos := range s.subs {
+		if mqtt.Match(filter, topic) {
+			if !ok || qos > max {
+				max = qos
+			}
+			ok = true
+		}
+	}
+	return max, ok
+}
+
+// deliver sends the message to the client with the given QoS, while the
+// client is offline QoS 1 and QoS 2 messages are queued and QoS 0 dropped.
+//
+// Retained messages are delivered by the subscriber's own goroutine after
+// SUBACK, so they wait for space in the outgoing queue, for routed ones
+// see the Broker documentation.
+func (s *session) deliver(pk *packet.Publish, qos packet.QoS, retain bool) {
+	out := packet.NewPublish(pk.Topic,
+		packet.WithPublishQoS(qos),
+		packet.WithPublishRetain(retain),
+		packet.WithPublishPayload(pk.Payload),
+	)
+
+	s.mu.Lock()
+	c := s.conn
+	if c == nil {
+		offline := s.owner == nil
+		queued := s.enqueue(out, offline)
+		s.mu.Unlock()
+		if queued && offline {
+			s.b.persist(s)
+		}
+		return
+	}
+	if qos != packet.QoS0 && !s.track(out) {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	// clean sessions lose in-flight messages on disconnect
+	if retain || (qos != packet.QoS0 && s.clean) {
+		c.send(out)
+		return
+	}
+	if c.offer(out) {
+		return
+	}
+	if qos == packet.QoS0 {
+		s.b.logf("%s: outgoing queue is full, message to %q is dropped", s.id, pk.Topic)
+		return
+	}
+	// the message is in-flight, so it's resent when the client reconnects
+	s.b.logf("%s: outgoing queue is full, disconnecting", s.id)
+	c.close()
+}
+
+// enqueue adds the message to the queue unless it's full, s.mu must be held.
+func (s *session) enqueue(pk *packet.Publish, offline bool) bool {
+	switch {
+	case offline && qosOf(pk) == packet.QoS0:
+		return false
+	case s.b.maxQueued > 0 && len(s.queue) >= s.b.maxQueued:
+		s.b.logf("%s: queue is full, message to %q is dropped", s.id, pk.Topic)
+		return false
+	}
+	s.queue = append(s.queue, pk)
+	return true
+}
+
+// track assigns a packet identifier to the message and records it
+// as in-flight, it reports false when no identifiers are available,
+// s.mu must be held.
+func (s *session) track(pk *packet.Publish) bool {
+	id, ok := s.allocID()
+	if !ok {
+		s.b.logf("%s: no packet ids available, message to %q is dropped", s.id, pk.Topic)
+		return false
+	}
+	pk.PacketID = id
+	s.inflight[id] = pk
+	s.order = append(s.order, id)
+	return true
+}
+
+// allocID returns a packet identifier not used by in-flight messages.
+func (s *session) allocID() (uint16, bool) {
+	for i := 0; i < 0xffff; i++ {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		if _, ok := s.inflight[s.nextID]; !ok {
+			return s.nextID, true
+		}
+	}
+	return 0, false
+}
+
+// acknowledge completes QoS 1 flows on PUBACK and QoS 2 flows on PUBCOMP.
+func (s *session) acknowledge(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inflight[id]; !ok {
+		return
+	}
+	delete(s.inflight, id)
+	delete(s.released, id)
+	for i, v := range s.order {
+		if v == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// release marks the QoS 2 message as received by the client on PUBREC.
+func (s *session) release(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inflight[id]; ok {
+		s.released[id] = struct{}{}
+	}
+}
+
+// receive records the incoming QoS 2 packet id, it reports
+// false for duplicates that are not released yet.
+func (s *session) receive(id uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inbound[id]; ok {
+		return false
+	}
+	s.inbound[id] = struct{}{}
+	return true
+}
+
+// complete releases the incoming QoS 2 packet id on PUBREL.
+func (s *session) complete(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inbound, id)
+}
+
+// state returns a snapshot of the session, Broker.mu must be held.
+func (s *session) state() *SessionState {
+	st := &SessionState{
+		ClientID:      s.id,
+		Subscriptions: make(map[string]packet.QoS, len(s.subs)),
+	}
+	for filter, qos := range s.subs {
+		st.Subscriptions[filter] = qos
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.order {
+		st.Messages = append(st.Messages, s.inflight[id])
+		if _, ok := s.released[id]; ok {
+			st.Released = append(st.Released, id)
+		}
+	}
+	for _, pk := range s.queue {
+		if qosOf(pk) != packet.QoS0 {
+			st.Messages = append(st.Messages, pk)
+		}
+	}
+	for id := range s.inbound {
+		st.Inbound = append(st.Inbound, id)
+	}
+	sort.Slice(st.Inbound, func(i, j int) bool {
+		return st.Inbound[i] < st.Inbound[j]
+	})
+	return st
+}
+
+// restoreSession creates an offline session from the stored state.
+func restoreSession(b *Broker, st *SessionState) *session {
+	s := newSession(b, st.ClientID, false)
+	for filter, qos := range st.Subscriptions {
+		s.subs[filter] = qos
+	}
+	for _, pk := range st.Messages {
+		if pk.PacketID == 0 {
+			s.queue = append(s.queue, pk)
+			continue
+		}
+		s.inflight[pk.PacketID] = pk
+		s.order = append(s.order, pk.PacketID)
+		s.nextID = pk.PacketID
+	}
+	for _, id := range st.Released {
+		if _, ok := s.inflight[id]; ok {
+			s.released[id] = struct{}{}
+		}
+	}
+	for _, id := range st.Inbound {
+		s.inbound[id] = struct{}{}
+	}
+	return s
+}
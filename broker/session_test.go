@@ -0,0 +1,246 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestPersistentSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, addr := newBroker(t, WithSessionStore(store), WithMaxQueuedMessages(2))
+	conn, dec, connack := sessionConnect(t, addr, "p", false)
+	if sessionPresent(connack) {
+		t.Fatal("session is present on the first connect")
+	}
+	if err = mqtt.NewEncoder(conn).Encode(packet.NewSubscribe(
+		packet.WithSubscribePacketID(1),
+		packet.WithSubscribeTopic("a/#", packet.QoS1),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sessionRecv(t, conn, dec).(*packet.Suback); !ok {
+		t.Fatal("suback expected")
+	}
+	sessionDisconnect(t, conn, dec)
+
+	// QoS 0 messages and ones that don't fit in the queue are dropped
+	pub := newClient(t, addr, "pub")
+	for i, qos := range []packet.QoS{packet.QoS0, packet.QoS1, packet.QoS2, packet.QoS1} {
+		if err = pub.Publish(context.Background(), "a/b",
+			packet.WithPublishQoS(qos),
+			packet.WithPublishPayload([]byte{byte(i)}),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub.Close()
+
+	conn, dec, connack = sessionConnect(t, addr, "p", false)
+	if !sessionPresent(connack) {
+		t.Fatal("session is not present")
+	}
+	for i, want := range []packet.QoS{packet.QoS1, packet.QoS1} {
+		pk := sessionRecv(t, conn, dec).(*packet.Publish)
+		if pk.Payload[0] != byte(i+1) || qosOf(pk) != want || enabled(pk.Flags, packet.PublishDup) {
+			t.Fatalf("recv = %s, want payload %d", pk, i+1)
+		}
+	}
+	sessionDisconnect(t, conn, dec)
+	b.Close()
+
+	// unacknowledged messages are resent with DUP after restart
+	b, addr = newBroker(t, WithSessionStore(store))
+	defer b.Close()
+	conn, dec, connack = sessionConnect(t, addr, "p", false)
+	if !sessionPresent(connack) {
+		t.Fatal("session is not present after restart")
+	}
+	for i := 1; i <= 2; i++ {
+		pk := sessionRecv(t, conn, dec).(*packet.Publish)
+		if pk.Payload[0] != byte(i) || !enabled(pk.Flags, packet.PublishDup) {
+			t.Fatalf("recv = %s, want payload %d with DUP", pk, i)
+		}
+		if err = mqtt.NewEncoder(conn).Encode(packet.NewPuback(pk.PacketID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// subscriptions survive restarts too
+	pub = newClient(t, addr, "pub")
+	defer pub.Close()
+	if err = pub.Publish(context.Background(), "a/c", packet.WithPublishQoS(packet.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	if pk := sessionRecv(t, conn, dec).(*packet.Publish); pk.Topic != "a/c" {
+		t.Fatalf("recv = %s, want a/c", pk)
+	}
+	conn.Close()
+
+	// clean session discards the stored one
+	conn, _, connack = sessionConnect(t, addr, "p", true)
+	conn.Close()
+	if sessionPresent(connack) {
+		t.Fatal("session is present with clean session")
+	}
+	states, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("%d sessions are stored, want none", len(states))
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	b, addr := newBroker(t, WithSessionExpiry(100*time.Millisecond))
+	defer b.Close()
+
+	for _, wait := range []time.Duration{0, 300 * time.Millisecond} {
+		conn, dec, _ := sessionConnect(t, addr, "p", false)
+		sessionDisconnect(t, conn, dec)
+		time.Sleep(wait)
+	}
+	conn, _, connack := sessionConnect(t, addr, "p", false)
+	conn.Close()
+	if sessionPresent(connack) {
+		t.Fatal("session is present after expiry")
+	}
+}
+
+func TestPersistBatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{SessionStore: fs}
+	b, addr := newBroker(t, WithSessionStore(store))
+	conn, dec, _ := sessionConnect(t, addr, "p", false)
+	if err = mqtt.NewEncoder(conn).Encode(packet.NewSubscribe(
+		packet.WithSubscribePacketID(1),
+		packet.WithSubscribeTopic("a", packet.QoS1),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sessionRecv(t, conn, dec).(*packet.Suback); !ok {
+		t.Fatal("suback expected")
+	}
+	sessionDisconnect(t, conn, dec)
+
+	pub := newClient(t, addr, "pub")
+	defer pub.Close()
+	saves := store.saves()
+	for i := 0; i < 100; i++ {
+		if err = pub.Publish(context.Background(), "a", packet.WithPublishQoS(packet.QoS1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close()
+	if n := store.saves() - saves; n == 0 || n > 10 {
+		t.Fatalf("session is saved %d times for 100 queued messages", n)
+	}
+	states, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || len(states[0].Messages) != 100 {
+		t.Fatalf("stored states = %v, want one with 100 messages", states)
+	}
+}
+
+// countingStore counts Save calls.
+type countingStore struct {
+	SessionStore
+	mu sync.Mutex
+	n  int
+}
+
+func (s *countingStore) Save(state *SessionState) error {
+	s.mu.Lock()
+	s.n++
+	s.mu.Unlock()
+	return s.SessionStore.Save(state)
+}
+
+func (s *countingStore) saves() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+func sessionPresent(connack *packet.Connack) bool {
+	return connack.AcknowledgeFlags&packet.AcknowledgeSessionPresent != 0
+}
+
+// sessionConnect connects to the broker and returns the decoder that
+// may have buffered packets sent after CONNACK.
+func sessionConnect(t *testing.T, addr, id string, clean bool) (net.Conn, *mqtt.Decoder, *packet.Connack) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mqtt.NewEncoder(conn).Encode(packet.NewConnect(
+		packet.WithConnectClientID(id),
+		packet.WithConnectCleanSession(clean),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	dec := mqtt.NewDecoder(conn)
+	connack, ok := sessionRecv(t, conn, dec).(*packet.Connack)
+	if !ok || connack.ReturnCode != packet.ConnectionAccepted {
+		t.Fatalf("connack = %v", connack)
+	}
+	return conn, dec, connack
+}
+
+// sessionDisconnect sends DISCONNECT and waits for the broker to close
+// the connection, that happens after the session is detached.
+func sessionDisconnect(t *testing.T, conn net.Conn, dec *mqtt.Decoder) {
+	t.Helper()
+	defer conn.Close()
+	if err := mqtt.NewEncoder(conn).Encode(packet.NewDisconnect()); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := dec.Decode(); err != nil {
+			return
+		}
+	}
+}
+
+func sessionRecv(t *testing.T, conn net.Conn, dec *mqtt.Decoder) packet.IncomingPacket {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
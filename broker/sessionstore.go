@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/internal/atomicfile"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// SessionState is the state of a session of a client
+// connected without the clean session flag.
+type SessionState struct {
+	ClientID      string
+	Subscriptions map[string]packet.QoS
+
+	// Messages are QoS 1 and QoS 2 messages not acknowledged by the client
+	// in the order they're routed, ones that have been sent have packet ids.
+	Messages []*packet.Publish
+
+	// Released are packet ids of QoS 2 messages the client has sent PUBREC for.
+	Released []uint16
+
+	// Inbound are packet ids of QoS 2 messages received from the client
+	// and not released yet.
+	Inbound []uint16
+
+	// ExpiresAt is the time the session of the offline client expires,
+	// it's zero for connected clients and when sessions never expire.
+	ExpiresAt time.Time
+}
+
+// SessionStore persists sessions, so they survive broker restarts.
+//
+// Sessions are saved when clients connect, subscribe, unsubscribe and
+// disconnect, messages queued for offline clients are saved in batches
+// shortly after they're routed, so those and messages in flight to
+// connected clients can be lost when the broker crashes.
+//
+// Implementations have to be safe for concurrent use.
+type SessionStore interface {
+	// Save stores the session replacing the previous state.
+	Save(state *SessionState) error
+
+	// Delete removes the session, it's not an error if it doesn't exist.
+	Delete(clientID string) error
+
+	// Load returns all stored sessions.
+	Load() ([]*SessionState, error)
+}
+
+// WithSessionStore sets the session store, the broker restores sessions
+// from it on creation, by default sessions are kept in memory only.
+func WithSessionStore(store SessionStore) Option {
+	return func(b *Broker) {
+		b.sessionStore = store
+	}
+}
+
+// NewFileSessionStore creates a store that keeps every session as a JSON
+// file in the given directory, after a crash each session is restored
+// either as it was before or after its last update.
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+type fileSessionStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+const fileSessionPrefix = "session-"
+
+// name returns the file name of the session, client ids are
+// hashed because they may contain any characters.
+func (s *fileSessionStore) name(clientID string) string {
+	sum := sha256.Sum256([]byte(clientID))
+	return filepath.Join(s.dir, fileSessionPrefix+hex.EncodeToString(sum[:]))
+}
+
+func (s *fileSessionStore) Save(state *SessionState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return atomicfile.Write(s.name(state.ClientID), b)
+}
+
+func (s *fileSessionStore) Delete(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.name(clientID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileSessionStore) Load() ([]*SessionState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var states []*SessionState
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), fileSessionPrefix) || strings.HasSuffix(fi.Name(), atomicfile.TmpSuffix) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var state SessionState
+		if err = json.Unmarshal(b, &state); err != nil {
+			return nil, fmt.Errorf("corrupted file %q: %s", fi.Name(), err)
+		}
+		states = append(states, &state)
+	}
+	return states, nil
+}
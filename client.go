@@ -7,7 +7,7 @@ import (
 	"io"
 	"log"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	"github.com/amenzhinsky/mqtt/packet"
 )
@@ -45,6 +45,14 @@ func WithMessagesHandler(handler MessagesHandler) Option {
 	}
 }
 
+// WithPingTimeout sets how long to wait for PINGRESP to keep-alive
+// pings before closing the connection, it's the keep-alive interval by default.
+func WithPingTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.pingTimeout = d
+	}
+}
+
 func newEncoderDecoder(rw io.ReadWriteCloser) *encoderDecoder {
 	return &encoderDecoder{NewEncoder(rw), NewDecoder(rw)}
 }
@@ -54,59 +62,87 @@ type encoderDecoder struct {
 	*Decoder
 }
 
+func (ed *encoderDecoder) SetProtocolLevel(level uint8) {
+	ed.Encoder.SetProtocolLevel(level)
+	ed.Decoder.SetProtocolLevel(level)
+}
+
 func (ed *encoderDecoder) Close() error {
 	return ed.Encoder.w.(io.Closer).Close()
 }
 
-func New(rw io.ReadWriteCloser, opts ...Option) *Client {
-	c := &Client{
-		rw: newEncoderDecoder(rw),
+// ErrClosed is returned by operations on closed clients.
+var ErrClosed = errors.New("client closed")
 
-		logger: &stdLogger{},
-		outc:   make(chan *out),
-		done:   make(chan struct{}),
+// New creates a client that talks over the given connection,
+// the client is closed as soon as the connection is lost.
+func New(rw io.ReadWriteCloser, opts ...Option) *Client {
+	c := makeClient(opts...)
+	c.setReady(c.start(rw))
+	return c
+}
 
-		connackc:  make(chan *packet.Connack),
-		pingrespc: make(chan *packet.Pingresp),
-		subackc:   make(chan *packet.Suback),
-		unsubackc: make(chan *packet.Unsuback),
-		pubackc:   make(chan *packet.Puback),
-		pubrecc:   make(chan *packet.Pubrec),
-		pubcompc:  make(chan *packet.Pubcomp),
+func makeClient(opts ...Option) *Client {
+	c := &Client{
+		logger:   &stdLogger{},
+		inbound:  make(map[uint16]struct{}),
+		inflight: newInflight(),
+		window:   newWindow(),
+		store:    NewMemoryStore(),
+		mux:      NewServeMux(),
+		subs:     make(map[string]uint8),
+		readyc:   make(chan struct{}),
+		done:     make(chan struct{}),
+		backoff:  DefaultBackoff,
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	for _, opt := range opts {
 		opt(c)
 	}
-	go c.rx()
-	go c.tx()
+	if c.workers != nil {
+		c.startWorkers()
+	}
 	return c
 }
 
 type Client struct {
-	mu sync.Mutex
-	rw *encoderDecoder
-
-	pkid    uint32
-	outc    chan *out
-	done    chan struct{}
-	err     error
-	handler MessagesHandler
-	logger  Logger
-	inInt   IncomingInterceptor
-	outInt  OutgoingInterceptor
-
-	connackc  chan *packet.Connack
-	pingrespc chan *packet.Pingresp
-	subackc   chan *packet.Suback
-	unsubackc chan *packet.Unsuback
-	pubackc   chan *packet.Puback
-	pubrecc   chan *packet.Pubrec
-	pubcompc  chan *packet.Pubcomp
-}
-
-type out struct {
-	pk   packet.OutgoingPacket
-	done chan struct{}
+	mu     sync.Mutex
+	conn   *conn         // nil when the client is not ready to send packets
+	readyc chan struct{} // closed when conn is set
+
+	inflight   *inflight
+	window     *window
+	done       chan struct{}
+	err        error
+	ctx        context.Context // canceled on close
+	cancel     context.CancelFunc
+	handler    MessagesHandler
+	ctxHandler ContextMessagesHandler
+	workers    *workerPool
+	mux        *ServeMux
+	logger     Logger
+	inInt      IncomingInterceptor
+	outInt     OutgoingInterceptor
+
+	inmu    sync.Mutex
+	inbound map[uint16]struct{} // QoS 2 packet ids received but not released
+
+	store    Store
+	restored bool // the store is loaded only once, guarded by mu
+
+	queue  *Queue
+	queued int // messages queued or being flushed, guarded by mu
+
+	subs map[string]uint8 // active subscriptions to their options, guarded by mu
+
+	pingTimeout time.Duration
+
+	dialer        Dialer
+	dialConfig    dialConfig // used by Dial only
+	backoff       Backoff
+	connectOpts   []packet.ConnectOption
+	connecting    bool
+	disconnecting bool
 }
 
 type Logger interface {
@@ -119,24 +155,234 @@ func (*stdLogger) Output(calldepth int, s string) error {
 	return log.Output(calldepth+1, "[mqtt] "+s) // +1 for this function
 }
 
-func (c *Client) genID() uint16 {
-	return uint16(atomic.AddUint32(&c.pkid, 1))
+// start starts receiving and transmitting packets over the given connection.
+func (c *Client) start(rw io.ReadWriteCloser) *conn {
+	cn := newConn(rw)
+	go c.rx(cn)
+	go c.tx(cn)
+	return cn
 }
 
+// setReady makes the connection available for sending packets,
+// it's closed right away when the client has been closed meanwhile.
+func (c *Client) setReady(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		cn.close(c.err)
+		return
+	default:
+	}
+	c.conn = cn
+	close(c.readyc)
+}
+
+// ready waits for a connection that is ready for sending packets.
+func (c *Client) ready(ctx context.Context) (*conn, error) {
+	for {
+		c.mu.Lock()
+		cn, readyc := c.conn, c.readyc
+		c.mu.Unlock()
+		if cn != nil {
+			return cn, nil
+		}
+		select {
+		case <-readyc:
+		case <-c.done:
+			return nil, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lost closes the connection and closes the client
+// as well unless it's able to reconnect.
+func (c *Client) lost(cn *conn, err error) {
+	cn.close(err)
+	c.mu.Lock()
+	if c.conn == cn {
+		c.conn = nil
+		c.readyc = make(chan struct{})
+	}
+	c.mu.Unlock()
+	if c.dialer == nil {
+		c.close(cn.err)
+	}
+}
+
+// acquire registers the given packet id in the inflight table
+// or allocates a free one when it's zero.
+func (c *Client) acquire(
+	ctx context.Context, id uint16,
+) (uint16, <-chan packet.IncomingPacket, error) {
+	if id == 0 {
+		id, ackc, err := c.inflight.alloc(ctx, c.done)
+		if err == errClosed {
+			return 0, nil, c.err
+		}
+		return id, ackc, err
+	}
+	ackc, err := c.inflight.add(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, ackc, nil
+}
+
+// acquirePublish takes a slot in the in-flight window
+// and registers the packet id of a QoS 1 or QoS 2 message.
+func (c *Client) acquirePublish(
+	ctx context.Context, id uint16,
+) (uint16, <-chan packet.IncomingPacket, error) {
+	if err := c.window.acquire(ctx, c.done); err != nil {
+		if err == errClosed {
+			return 0, nil, c.err
+		}
+		return 0, nil, err
+	}
+	id, ackc, err := c.acquire(ctx, id)
+	if err != nil {
+		c.window.release()
+		return 0, nil, err
+	}
+	return id, ackc, nil
+}
+
+// releasePublish releases resources taken by acquirePublish.
+func (c *Client) releasePublish(id uint16) {
+	c.inflight.delete(id)
+	c.window.release()
+}
+
+// Connect sends CONNECT to the server and waits for CONNACK,
+// clients with a dialer establish a new connection first and
+// use the same options every time they reconnect.
 func (c *Client) Connect(
 	ctx context.Context, opts ...packet.ConnectOption,
 ) (*packet.Connack, error) {
-	connect := packet.NewConnect(opts...)
-	if err := c.send(ctx, connect); err != nil {
+	n, err := c.restore(opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.dialer != nil {
+		return c.connect(ctx, opts)
+	}
+	cn, err := c.ready(ctx)
+	if err != nil {
+		return nil, err
+	}
+	connack, err := c.handshake(ctx, cn, packet.NewConnect(opts...))
+	if err != nil {
+		return connack, err
+	}
+	if n != 0 {
+		if err = c.retransmit(ctx, cn); err != nil {
+			return nil, err
+		}
+	}
+	return connack, nil
+}
+
+// restore loads the store on the first connect unless the session is clean,
+// it returns the number of outgoing packets that have to be resent,
+// their flows are completed in the background.
+func (c *Client) restore(opts []packet.ConnectOption) (int, error) {
+	c.mu.Lock()
+	restored := c.restored
+	c.restored = true
+	c.mu.Unlock()
+	if restored {
+		return 0, nil
+	}
+	if packet.NewConnect(opts...).ConnectFlags&packet.ConnectFlagCleanSession != 0 {
+		return 0, c.store.Reset()
+	}
+
+	incoming, err := c.store.Load(Incoming)
+	if err != nil {
+		return 0, err
+	}
+	c.inmu.Lock()
+	for _, pk := range incoming {
+		c.inbound[packetID(pk)] = struct{}{}
+	}
+	c.inmu.Unlock()
+
+	outgoing, err := c.store.Load(Outgoing)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, pk := range outgoing {
+		id := packetID(pk)
+		ackc, err := c.inflight.add(id)
+		if err == errPacketIDInUse {
+			continue // stored by an operation started before connecting
+		} else if err != nil {
+			return 0, err
+		}
+		c.inflight.track(id, pk)
+		c.window.take()
+		go c.resume(id, pk, ackc)
+		n++
+	}
+	return n, nil
+}
+
+// resume completes a flow restored from the store.
+func (c *Client) resume(id uint16, pk packet.Packet, ackc <-chan packet.IncomingPacket) {
+	defer c.releasePublish(id)
+	var err error
+	switch v := pk.(type) {
+	case *packet.Publish:
+		err = c.acknowledge(c.ctx, v, ackc)
+	case *packet.Pubrel:
+		err = c.complete(c.ctx, id, ackc)
+	}
+	if err != nil {
+		c.logf("restored flow m%d failed: %s", id, err)
+	}
+}
+
+// handshake sends CONNECT over the given connection and waits for CONNACK,
+// it starts sending keep-alive pings when the connection is accepted.
+func (c *Client) handshake(
+	ctx context.Context, cn *conn, connect *packet.Connect,
+) (*packet.Connack, error) {
+	cn.rw.SetProtocolLevel(connect.ProtocolLevel)
+	if _, err := cn.send(ctx, &out{pk: connect, done: make(chan struct{})}); err != nil {
 		return nil, err
 	}
 	select {
-	case connack := <-c.connackc:
+	case connack := <-cn.connackc:
+		if connack.ReasonCode.Failed() {
+			return connack, fmt.Errorf("connection failed: %s (%d)",
+				connack.ReasonCode.String(), connack.ReasonCode)
+		}
 		if connack.ReturnCode != packet.ConnectionAccepted {
-			return nil, fmt.Errorf("connection failed: %s (%d)",
+			return connack, fmt.Errorf("connection failed: %s (%d)",
 				connack.ReturnCode.String(), connack.ReturnCode)
 		}
+		var receiveMaximum int
+		if rm := connack.Properties.ReceiveMaximum; rm != nil {
+			receiveMaximum = int(*rm)
+		}
+		c.window.setReceiveMaximum(receiveMaximum)
+
+		keepAlive := connect.KeepAlive
+		if ka := connack.Properties.ServerKeepAlive; ka != nil {
+			keepAlive = *ka
+		}
+		if keepAlive != 0 {
+			cn.pingOnce.Do(func() {
+				go c.keepAlive(cn, time.Duration(keepAlive)*time.Second)
+			})
+		}
 		return connack, nil
+	case <-cn.done:
+		return nil, cn.err
 	case <-c.done:
 		return nil, c.err
 	case <-ctx.Done():
@@ -145,12 +391,45 @@ func (c *Client) Connect(
 }
 
 func (c *Client) Ping(ctx context.Context) error {
-	if err := c.send(ctx, packet.NewPingreq()); err != nil {
+	cn, err := c.ready(ctx)
+	if err != nil {
 		return err
 	}
+	return c.ping(ctx, cn)
+}
+
+// ping sends PINGREQ and waits for PINGRESP, when another ping
+// is in flight it waits for that one instead of sending a new one.
+func (c *Client) ping(ctx context.Context, cn *conn) error {
+	cn.pmu.Lock()
+	p := cn.pong
+	if p == nil {
+		p = &pong{done: make(chan struct{})}
+		cn.pong = p
+		cn.pmu.Unlock()
+		if _, err := cn.send(ctx, &out{pk: packet.NewPingreq(), done: make(chan struct{})}); err != nil {
+			// the packet may have been written anyway and
+			// the response completes the ping then
+			cn.pmu.Lock()
+			failed := cn.pong == p
+			if failed {
+				cn.pong = nil
+			}
+			cn.pmu.Unlock()
+			if failed {
+				p.err = err
+				close(p.done)
+			}
+			return err
+		}
+	} else {
+		cn.pmu.Unlock()
+	}
 	select {
-	case <-c.pingrespc:
-		return nil
+	case <-p.done:
+		return p.err
+	case <-cn.done:
+		return cn.err
 	case <-c.done:
 		return c.err
 	case <-ctx.Done():
@@ -158,70 +437,168 @@ func (c *Client) Ping(ctx context.Context) error {
 	}
 }
 
-func (c *Client) Disconnect(ctx context.Context) error {
-	return c.send(ctx, packet.NewDisconnect())
+// Disconnect sends DISCONNECT to the server,
+// clients with a dialer are closed afterwards and stop reconnecting.
+func (c *Client) Disconnect(ctx context.Context, opts ...packet.DisconnectOption) error {
+	if c.dialer == nil {
+		return c.send(ctx, packet.NewDisconnect(opts...))
+	}
+	c.mu.Lock()
+	c.disconnecting = true
+	c.mu.Unlock()
+	err := c.send(ctx, packet.NewDisconnect(opts...))
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
-var (
-	errInvalidPacketID = errors.New("invalid packet id")
-)
+// reasonError converts a failed MQTT 5.0 reason code into an error.
+func reasonError(rc packet.ReasonCode) error {
+	if rc.Failed() {
+		return fmt.Errorf("%s (%d)", rc.String(), rc)
+	}
+	return nil
+}
+
+func unexpectedPacketError(pk packet.IncomingPacket) error {
+	return fmt.Errorf("unexpected packet: %s", pk)
+}
 
 func (c *Client) Publish(
 	ctx context.Context, topic string, opts ...packet.PublishOption,
 ) error {
+	publish, ackc, err := c.publish(ctx, nil, topic, opts...)
+	if err != nil || ackc == nil {
+		return err
+	}
+	select {
+	case err = <-c.finish(publish, ackc):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish completes the QoS 1 or QoS 2 flow of the sent publish in the
+// background, the packet id stays in use until the flow is done or the
+// client is closed even if the caller stops waiting for the result,
+// so it's not reused while the server may still acknowledge it.
+func (c *Client) finish(publish *packet.Publish, ackc <-chan packet.IncomingPacket) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		defer c.releasePublish(publish.PacketID)
+		errc <- c.acknowledge(c.ctx, publish, ackc)
+	}()
+	return errc
+}
+
+// publish sends the packet or queues it when the client is offline,
+// for sent QoS 1 and QoS 2 packets it returns the channel acknowledgements
+// are delivered to, the packet id has to be released when the flow is done.
+//
+// The returned packet is nil when it's queued, done is called
+// with the result when it's published or dropped later.
+func (c *Client) publish(
+	ctx context.Context, done func(err error), topic string, opts ...packet.PublishOption,
+) (*packet.Publish, <-chan packet.IncomingPacket, error) {
 	publish := packet.NewPublish(topic, opts...)
-	qos1 := enabled(publish.Flags, packet.PublishQoS1)
-	qos2 := enabled(publish.Flags, packet.PublishQoS2)
-	if (!qos1 && !qos2) && publish.PacketID != 0 {
-		return errors.New("non-zero packet-id for QoS0")
-	} else if (qos1 || qos2) && publish.PacketID == 0 {
-		publish.PacketID = c.genID()
+	// MQTT 5.0 topic aliases replace topic names
+	if topic != "" || publish.Properties.TopicAlias == nil {
+		if err := ValidateTopicName(topic); err != nil {
+			return nil, nil, err
+		}
+	}
+	qos0 := !enabled(publish.Flags, packet.PublishQoS1|packet.PublishQoS2)
+	if qos0 && publish.PacketID != 0 {
+		return nil, nil, errors.New("non-zero packet-id for QoS0")
+	}
+	if c.enqueue() {
+		dropped, err := c.queue.push(ctx, publish, done)
+		for _, fn := range dropped {
+			c.dequeued()
+			if fn != nil {
+				fn(ErrQueueFull)
+			}
+		}
+		if err != nil {
+			c.dequeued()
+			return nil, nil, err
+		}
+		return nil, nil, nil
+	}
+	if qos0 {
+		return publish, nil, c.send(ctx, publish)
+	}
+	var ackc <-chan packet.IncomingPacket
+	var err error
+	publish.PacketID, ackc, err = c.acquirePublish(ctx, publish.PacketID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = c.sendTracked(ctx, publish.PacketID, publish); err != nil {
+		// the packet hasn't reached the transmitter, so it's not in flight
+		c.releasePublish(publish.PacketID)
+		if derr := c.store.Delete(Outgoing, publish.PacketID); derr != nil {
+			c.logf("store error: %s", derr)
+		}
+		return nil, nil, err
 	}
+	return publish, ackc, nil
+}
 
-	if err := c.send(ctx, publish); err != nil {
+// acknowledge waits for acknowledgements of the sent QoS 1 or QoS 2
+// publish and completes the flow, the packet is removed from the store
+// only when the flow is complete, so it's resent after restarts otherwise.
+func (c *Client) acknowledge(
+	ctx context.Context, publish *packet.Publish, ackc <-chan packet.IncomingPacket,
+) error {
+	pk, err := c.await(ctx, ackc)
+	if err != nil {
 		return err
 	}
-	switch {
-	case qos1:
-		select {
-		case puback := <-c.pubackc:
-			if puback.PacketID != publish.PacketID {
-				return errInvalidPacketID
-			}
-			return nil
-		case <-c.done:
-			return c.err
-		case <-ctx.Done():
-			return ctx.Err()
+	if enabled(publish.Flags, packet.PublishQoS1) {
+		puback, ok := pk.(*packet.Puback)
+		if !ok {
+			return unexpectedPacketError(pk)
 		}
-	case qos2:
-		select {
-		case pubrec := <-c.pubrecc:
-			if pubrec.PacketID != publish.PacketID {
-				return errInvalidPacketID
-			}
-			if err := c.send(ctx, packet.NewPubrel(publish.PacketID)); err != nil {
-				return err
-			}
-			select {
-			case pubcomp := <-c.pubcompc:
-				if pubcomp.PacketID != publish.PacketID {
-					return errInvalidPacketID
-				}
-				return nil
-			case <-c.done:
-				return c.err
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		case <-c.done:
-			return c.err
-		case <-ctx.Done():
-			return ctx.Err()
+		if err = c.store.Delete(Outgoing, publish.PacketID); err != nil {
+			return err
 		}
-	default:
-		return nil
+		return reasonError(puback.ReasonCode)
+	}
+
+	pubrec, ok := pk.(*packet.Pubrec)
+	if !ok {
+		return unexpectedPacketError(pk)
+	}
+	if err = reasonError(pubrec.ReasonCode); err != nil {
+		// MQTT 5.0 servers end the flow with failed PUBREC
+		if derr := c.store.Delete(Outgoing, publish.PacketID); derr != nil {
+			return derr
+		}
+		return err
+	}
+	if err = c.sendTracked(ctx, publish.PacketID, packet.NewPubrel(publish.PacketID)); err != nil {
+		return err
 	}
+	return c.complete(ctx, publish.PacketID, ackc)
+}
+
+// complete waits for PUBCOMP to the sent PUBREL.
+func (c *Client) complete(ctx context.Context, id uint16, ackc <-chan packet.IncomingPacket) error {
+	pk, err := c.await(ctx, ackc)
+	if err != nil {
+		return err
+	}
+	pubcomp, ok := pk.(*packet.Pubcomp)
+	if !ok {
+		return unexpectedPacketError(pk)
+	}
+	if err = c.store.Delete(Outgoing, id); err != nil {
+		return err
+	}
+	return reasonError(pubcomp.ReasonCode)
 }
 
 func enabled(flags packet.Flags, flag uint8) bool {
@@ -232,53 +609,109 @@ func (c *Client) Subscribe(
 	ctx context.Context, opts ...packet.SubscribeOption,
 ) (*packet.Suback, error) {
 	subscribe := packet.NewSubscribe(opts...)
-	if subscribe.PacketID == 0 {
-		subscribe.PacketID = c.genID()
+	for _, topic := range subscribe.Topics {
+		if err := ValidateTopicFilter(topic.Name); err != nil {
+			return nil, err
+		}
 	}
-	if err := c.send(ctx, subscribe); err != nil {
+	var ackc <-chan packet.IncomingPacket
+	var err error
+	subscribe.PacketID, ackc, err = c.acquire(ctx, subscribe.PacketID)
+	if err != nil {
 		return nil, err
 	}
-	select {
-	case suback := <-c.subackc:
-		if suback.PacketID != subscribe.PacketID {
-			return nil, errInvalidPacketID
+	defer c.inflight.delete(subscribe.PacketID)
+
+	if err = c.sendUnstored(ctx, subscribe.PacketID, subscribe); err != nil {
+		return nil, err
+	}
+	pk, err := c.await(ctx, ackc)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := pk.(*packet.Suback)
+	if !ok {
+		return nil, unexpectedPacketError(pk)
+	}
+
+	// remember granted subscriptions to restore them on reconnect
+	c.mu.Lock()
+	for i, topic := range subscribe.Topics {
+		if i < len(suback.ReturnCodes) && suback.ReturnCodes[i] < packet.SubscriptionFailure {
+			c.subs[topic.Name] = topic.Flags
 		}
-		return suback, nil
-	case <-c.done:
-		return nil, c.err
-	case <-ctx.Done():
-		return nil, ctx.Err()
 	}
+	c.mu.Unlock()
+	return suback, nil
 }
 
+// Unsubscribe unsubscribes from the topic filters,
+// handlers registered for them in the router are removed.
 func (c *Client) Unsubscribe(
 	ctx context.Context, opts ...packet.UnsubscribeOption,
 ) error {
 	unsubscribe := packet.NewUnsubscribe(opts...)
-	if unsubscribe.PacketID == 0 {
-		unsubscribe.PacketID = c.genID()
+	for _, topic := range unsubscribe.Topics {
+		if err := ValidateTopicFilter(topic); err != nil {
+			return err
+		}
 	}
-	if err := c.send(ctx, unsubscribe); err != nil {
+	var ackc <-chan packet.IncomingPacket
+	var err error
+	unsubscribe.PacketID, ackc, err = c.acquire(ctx, unsubscribe.PacketID)
+	if err != nil {
 		return err
 	}
-	select {
-	case unsuback := <-c.unsubackc:
-		if unsuback.PacketID != unsubscribe.PacketID {
-			return errInvalidPacketID
+	defer c.inflight.delete(unsubscribe.PacketID)
+
+	if err = c.sendUnstored(ctx, unsubscribe.PacketID, unsubscribe); err != nil {
+		return err
+	}
+	pk, err := c.await(ctx, ackc)
+	if err != nil {
+		return err
+	}
+	unsuback, ok := pk.(*packet.Unsuback)
+	if !ok {
+		return unexpectedPacketError(pk)
+	}
+
+	c.mu.Lock()
+	for _, topic := range unsubscribe.Topics {
+		delete(c.subs, topic)
+	}
+	c.mu.Unlock()
+	for _, topic := range unsubscribe.Topics {
+		c.mux.Remove(muxFilter(topic))
+	}
+	for _, rc := range unsuback.ReasonCodes {
+		if err = reasonError(packet.ReasonCode(rc)); err != nil {
+			return err
 		}
-		return nil
+	}
+	return nil
+}
+
+// await waits for an acknowledgement registered in the inflight table,
+// it keeps waiting when the connection is lost and the client reconnects.
+func (c *Client) await(
+	ctx context.Context, ackc <-chan packet.IncomingPacket,
+) (packet.IncomingPacket, error) {
+	select {
+	case pk := <-ackc:
+		return pk, nil
 	case <-c.done:
-		return c.err
+		return nil, c.err
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 }
 
-func (c *Client) rx() {
+func (c *Client) rx(cn *conn) {
 	for {
-		pk, err := c.rw.Decode()
+		pk, err := cn.rw.Decode()
 		if err != nil {
-			c.close(err)
+			c.lost(cn, err)
 			return
 		}
 		if c.inInt != nil {
@@ -287,74 +720,170 @@ func (c *Client) rx() {
 		switch v := pk.(type) {
 		case *packet.Connack:
 			select {
-			case c.connackc <- v:
-			case <-c.done:
+			case cn.connackc <- v:
 			default:
 				c.logf("unexpected: %s", v)
 			}
 		case *packet.Pingresp:
-			select {
-			case c.pingrespc <- v:
-			case <-c.done:
+			cn.pmu.Lock()
+			p := cn.pong
+			cn.pong = nil
+			cn.pmu.Unlock()
+			if p != nil {
+				close(p.done)
+			} else {
 				c.logf("unexpected: %s", v)
 			}
 		case *packet.Puback:
-			select {
-			case c.pubackc <- v:
-			case <-c.done:
-			default:
-				c.logf("unexpected: %s", v)
-			}
+			c.deliver(v.PacketID, v)
 		case *packet.Pubrec:
-			select {
-			case c.pubrecc <- v:
-			case <-c.done:
-			default:
-				c.logf("unexpected: %s", v)
-			}
+			c.deliver(v.PacketID, v)
 		case *packet.Pubcomp:
-			select {
-			case c.pubcompc <- v:
-			case <-c.done:
-			default:
-				c.logf("unexpected: %s", v)
-			}
+			c.deliver(v.PacketID, v)
 		case *packet.Suback:
-			select {
-			case c.subackc <- v:
-			case <-c.done:
-			default:
-				c.logf("unexpected: %s", v)
-			}
+			// the waiting goroutine reads codes while rx decodes next packets
+			cp := *v
+			cp.ReturnCodes = append([]byte(nil), v.ReturnCodes...)
+			c.deliver(v.PacketID, &cp)
 		case *packet.Unsuback:
-			select {
-			case c.unsubackc <- v:
-			case <-c.done:
-			default:
-				c.logf("unexpected: %s", v)
-			}
+			cp := *v
+			cp.ReasonCodes = append([]byte(nil), v.ReasonCodes...)
+			c.deliver(v.PacketID, &cp)
 		case *packet.Publish:
-			if c.handler != nil {
-				c.handler(v)
-			} else {
-				c.logf("unhandled: %s", v)
+			if err = c.receive(cn, v); err != nil {
+				c.lost(cn, err)
+				return
+			}
+		case *packet.Pubrel:
+			if err = c.release(cn, v); err != nil {
+				c.lost(cn, err)
+				return
 			}
+		case *packet.Disconnect:
+			// MQTT 5.0 servers notify clients before closing connections
+			c.lost(cn, fmt.Errorf("disconnected by server: %s (%d)",
+				v.ReasonCode.String(), v.ReasonCode))
+			return
+		case *packet.Auth:
+			c.logf("unsupported: %s", v)
 		default:
 			panic(fmt.Sprintf("unknown incomming packet: %#v", v))
 		}
 	}
 }
 
-func (c *Client) tx() {
-	for pk := range c.outc {
-		if c.outInt != nil {
-			c.outInt(pk.pk)
+func (c *Client) deliver(id uint16, pk packet.IncomingPacket) {
+	if !c.inflight.deliver(id, pk) {
+		c.logf("unexpected: %s", pk)
+	}
+}
+
+// receive delivers incoming publish packets to the handler and
+// acknowledges them according to their QoS level, QoS 2 messages
+// are delivered only once until they're released by the server.
+func (c *Client) receive(cn *conn, publish *packet.Publish) error {
+	switch {
+	case enabled(publish.Flags, packet.PublishQoS1):
+		c.handle(publish)
+		return c.reply(cn, packet.NewPuback(publish.PacketID))
+	case enabled(publish.Flags, packet.PublishQoS2):
+		c.inmu.Lock()
+		_, ok := c.inbound[publish.PacketID]
+		c.inbound[publish.PacketID] = struct{}{}
+		c.inmu.Unlock()
+		if !ok {
+			// the message is stored after it's handled, so it's
+			// delivered again if the process crashes in between
+			c.handle(publish)
+			if err := c.store.Put(Incoming, publish.PacketID, publish); err != nil {
+				return err
+			}
 		}
-		if err := c.rw.Encode(pk.pk); err != nil {
-			c.close(err)
+		return c.reply(cn, packet.NewPubrec(publish.PacketID))
+	default:
+		c.handle(publish)
+		return nil
+	}
+}
+
+// release completes the QoS 2 flow started by receive.
+func (c *Client) release(cn *conn, pubrel *packet.Pubrel) error {
+	var opts []packet.PubcompOption
+	c.inmu.Lock()
+	_, ok := c.inbound[pubrel.PacketID]
+	delete(c.inbound, pubrel.PacketID)
+	c.inmu.Unlock()
+	if err := c.store.Delete(Incoming, pubrel.PacketID); err != nil {
+		return err
+	}
+	if !ok {
+		// it's still acknowledged because the previous PUBCOMP may have been lost
+		c.logf("unknown packet id: %s", pubrel)
+		opts = append(opts, packet.WithPubcompReasonCode(packet.PacketIdentifierNotFound))
+	}
+	return c.reply(cn, packet.NewPubcomp(pubrel.PacketID, opts...))
+}
+
+// reply sends the packet over the connection it's replying to,
+// it makes no sense to send it over a new connection.
+func (c *Client) reply(cn *conn, pk packet.OutgoingPacket) error {
+	_, err := cn.send(context.Background(), &out{pk: pk, done: make(chan struct{})})
+	return err
+}
+
+func (c *Client) handle(publish *packet.Publish) {
+	if c.workers != nil {
+		c.enqueueWork(publish)
+	} else {
+		c.dispatch(publish)
+	}
+}
+
+// dispatch passes the message to the router or the messages handler.
+func (c *Client) dispatch(publish *packet.Publish) {
+	if c.mux.Dispatch(publish) {
+		return
+	}
+	switch {
+	case c.ctxHandler != nil:
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.ctxHandler(ctx, publish)
+		cancel()
+	case c.handler != nil:
+		c.handler(publish)
+	default:
+		c.logf("unhandled: %s", publish)
+	}
+}
+
+// copyPublish copies the packet along with its payload
+// that may share memory with the decoder's buffer.
+func copyPublish(publish *packet.Publish) *packet.Publish {
+	cp := *publish
+	cp.Payload = append([]byte(nil), publish.Payload...)
+	return &cp
+}
+
+func (c *Client) tx(cn *conn) {
+	defer close(cn.txdone)
+	for {
+		select {
+		case o := <-cn.outc:
+			if o.sent != nil {
+				o.sent()
+			}
+			if c.outInt != nil {
+				c.outInt(o.pk)
+			}
+			if err := cn.rw.Encode(o.pk); err != nil {
+				c.lost(cn, err)
+				return
+			}
+			cn.touch()
+			close(o.done)
+		case <-cn.done:
 			return
 		}
-		close(pk.done)
 	}
 }
 
@@ -365,33 +894,66 @@ func (c *Client) logf(format string, v ...interface{}) {
 }
 
 func (c *Client) send(ctx context.Context, pk packet.OutgoingPacket) error {
-	o := &out{pk: pk, done: make(chan struct{})}
-	select {
-	case c.outc <- o:
-		select {
-		case <-o.done:
-			return nil
-		case <-c.done:
-			return c.err
-		case <-ctx.Done():
-			return ctx.Err()
+	return c.sendOut(ctx, pk, nil)
+}
+
+// sendTracked stores and sends a packet that is retransmitted
+// on reconnect until the flow for the given packet id is complete.
+func (c *Client) sendTracked(ctx context.Context, id uint16, pk packet.Packet) error {
+	if err := c.store.Put(Outgoing, id, pk); err != nil {
+		return err
+	}
+	return c.sendOut(ctx, pk, func() {
+		c.inflight.track(id, pk)
+	})
+}
+
+// sendUnstored sends a packet that is retransmitted on reconnect
+// until it's acknowledged, but not kept in the store, it's used for
+// SUBSCRIBE and UNSUBSCRIBE that make no sense after a restart.
+func (c *Client) sendUnstored(ctx context.Context, id uint16, pk packet.OutgoingPacket) error {
+	return c.sendOut(ctx, pk, func() {
+		c.inflight.track(id, pk)
+	})
+}
+
+// sendOut waits for a ready connection and sends the packet over it,
+// when the connection is lost in the middle of the process and
+// the client is able to reconnect it waits for the next one.
+func (c *Client) sendOut(ctx context.Context, pk packet.OutgoingPacket, sent func()) error {
+	for {
+		cn, err := c.ready(ctx)
+		if err != nil {
+			return err
 		}
-	case <-c.done:
-		return c.err
-	case <-ctx.Done():
-		return ctx.Err()
+		lost, err := cn.send(ctx, &out{pk: pk, done: make(chan struct{}), sent: sent})
+		if lost && c.dialer != nil {
+			continue
+		}
+		return err
 	}
 }
 
 func (c *Client) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	select {
 	case <-c.done:
 	default:
 		c.err = err
 		close(c.done)
+		c.cancel()
 	}
 }
 
+// Close closes the client and its current connection.
 func (c *Client) Close() error {
-	return c.rw.Close()
+	c.close(ErrClosed)
+	c.mu.Lock()
+	cn := c.conn
+	c.mu.Unlock()
+	if cn != nil {
+		return cn.close(ErrClosed)
+	}
+	return nil
 }
@@ -1,114 +1,279 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
 	"errors"
-	"fmt"
-	"io"
 	"net"
-	"os"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/amenzhinsky/mqtt/packet"
 )
 
-func TestPing(t *testing.T) {
-	c := newClient(t)
+func TestKeepAlive(t *testing.T) {
+	c, s := newPipeClient(t, WithPingTimeout(100*time.Millisecond))
 	defer c.Close()
 
-	if _, err := c.Connect(
-		context.Background(),
-		packet.WithConnectKeepAlive(1),
-		packet.WithConnectCleanSession(true),
-	); err != nil {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), packet.WithConnectKeepAlive(1))
+		errc <- err
+	}()
+	if _, ok := s.recv().(*packet.Connect); !ok {
+		t.Fatal("connect expected")
+	}
+	s.send(packet.NewConnack())
+	if err := <-errc; err != nil {
 		t.Fatal(err)
 	}
 
-	time.Sleep(500 * time.Millisecond)
-	if err := c.Ping(context.Background()); err != nil {
-		t.Fatal(err)
+	start := time.Now()
+	s.expect(packet.NewPingreq())
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Fatalf("ping sent too early: %s", d)
 	}
+	s.send(packet.NewPingresp())
+
+	// no response this time
+	s.expect(packet.NewPingreq())
+	if err := c.Ping(context.Background()); !errors.Is(err, ErrPingTimeout) {
+		t.Fatalf("Ping() = %v, want %v", err, ErrPingTimeout)
+	}
+}
 
-	time.Sleep(2 * time.Second)
-	if err := c.Ping(context.Background()); !errors.Is(err, io.EOF) {
-		t.Fatalf("want EOF on expired keep alive, got %v", err)
+func TestConcurrentPing(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- c.Ping(context.Background())
+	}()
+	s.expect(packet.NewPingreq())
+
+	// the second ping waits for the one in flight
+	go func() {
+		errc <- c.Ping(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.send(packet.NewPingresp())
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ping timed out")
+		}
 	}
 }
 
-func TestPubSub(t *testing.T) {
-	pbc := make(chan *packet.Publish)
-	sub := newClient(t, WithMessagesHandler(func(publish *packet.Publish) {
+func TestInboundQoS(t *testing.T) {
+	pbc := make(chan *packet.Publish, 10)
+	c, s := newPipeClient(t, WithMessagesHandler(func(publish *packet.Publish) {
 		pbc <- publish
 	}))
-	defer sub.Close()
-	if _, err := sub.Connect(
-		context.Background(),
-		packet.WithConnectCleanSession(true),
-	); err != nil {
-		t.Fatal(err)
-	}
+	defer c.Close()
 
-	if _, err := sub.Subscribe(context.Background(),
-		packet.WithSubscribePacketID(666),
-		packet.WithSubscribeTopic("test/#", packet.QoS1),
-	); err != nil {
-		t.Fatal(err)
-	}
+	s.send(packet.NewPublish("a", packet.WithPublishQoS(packet.QoS1), packet.WithPublishPacketID(1)))
+	s.expect(packet.NewPuback(1))
 
-	pub := newClient(t)
-	defer pub.Close()
-	if _, err := pub.Connect(
-		context.Background(),
-		packet.WithConnectCleanSession(true),
-	); err != nil {
-		t.Fatal(err)
-	}
+	qos2 := packet.NewPublish("b", packet.WithPublishQoS(packet.QoS2), packet.WithPublishPacketID(2))
+	s.send(qos2)
+	s.expect(packet.NewPubrec(2))
+	s.send(packet.NewPublish("b",
+		packet.WithPublishQoS(packet.QoS2),
+		packet.WithPublishPacketID(2),
+		packet.WithPublishDup(true),
+	))
+	s.expect(packet.NewPubrec(2))
+	s.send(packet.NewPubrel(2))
+	s.expect(packet.NewPubcomp(2))
 
-	for _, qos := range []packet.QoS{packet.QoS0, packet.QoS1, packet.QoS2} {
-		if err := pub.Publish(context.Background(),
-			fmt.Sprintf("test/%d", qos),
-			packet.WithPublishQoS(qos),
-			packet.WithPublishPayload([]byte{byte(qos)}),
-		); err != nil {
-			t.Fatal(err)
-		}
+	// the same packet id can be reused after release
+	s.send(qos2)
+	s.expect(packet.NewPubrec(2))
 
+	for _, topic := range []string{"a", "b", "b"} {
 		select {
 		case p := <-pbc:
-			if len(p.Payload) != 1 {
-				t.Fatal("invalid payload length")
+			if p.Topic != topic {
+				t.Fatalf("topic = %q, want %q", p.Topic, topic)
 			}
-			if packet.QoS(p.Payload[0]) != qos {
-				t.Fatalf("qos = %d, want %d", p.Payload[0], qos)
-			}
-		case <-time.After(5 * time.Second):
+		case <-time.After(time.Second):
 			t.Fatal("recv timed out")
 		}
 	}
+	select {
+	case p := <-pbc:
+		t.Fatalf("unexpected delivery: %s", p)
+	default:
+	}
+}
 
-	if err := sub.Unsubscribe(context.Background(),
-		packet.WithUnsubscribeTopic("test/#"),
-	); err != nil {
-		t.Fatal(err)
+func TestConcurrentPublish(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	const n = 10
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errc <- c.Publish(context.Background(), "a",
+				packet.WithPublishQoS(packet.QoS1),
+				packet.WithPublishPacketID(uint16(i+1)),
+			)
+		}(i)
 	}
-	if err := sub.Disconnect(context.Background()); err != nil {
-		t.Fatal(err)
+
+	ids := make([]uint16, 0, n)
+	for i := 0; i < n; i++ {
+		publish, ok := s.recv().(*packet.Publish)
+		if !ok {
+			t.Fatal("publish expected")
+		}
+		ids = append(ids, publish.PacketID)
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		s.send(packet.NewPuback(ids[i]))
 	}
-	if err := pub.Disconnect(context.Background()); err != nil {
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPublishCancel(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Publish(ctx, "a",
+			packet.WithPublishQoS(packet.QoS1),
+			packet.WithPublishPacketID(1),
+		)
+	}()
+	s.recv()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// the id is in use until the server acknowledges it
+	if err := c.Publish(context.Background(), "a",
+		packet.WithPublishQoS(packet.QoS1),
+		packet.WithPublishPacketID(1),
+	); err != errPacketIDInUse {
+		t.Fatalf("err = %v, want %v", err, errPacketIDInUse)
+	}
+	s.send(packet.NewPuback(1))
+	for start := time.Now(); c.InflightStats().InFlight != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("packet id is not released")
+		}
+	}
+}
+
+func TestSubackCodes(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	type result struct {
+		suback *packet.Suback
+		err    error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		suback, err := c.Subscribe(context.Background(),
+			packet.WithSubscribeTopic("a", packet.QoS1),
+			packet.WithSubscribeTopic("b", packet.QoS1),
+		)
+		resc <- result{suback, err}
+	}()
+	subscribe := s.recv().(*packet.Subscribe)
+	s.send(packet.NewSuback(subscribe.PacketID, packet.WithSubackReturnCodes(1, 1)))
+	res := <-resc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// the next packet is decoded into the same buffer
+	s.send(packet.NewPublish("a", packet.WithPublishPayload(bytes.Repeat([]byte{0xee}, 4080))))
+	if err := ping(c, s); err != nil {
 		t.Fatal(err)
 	}
+	if rcs := res.suback.ReturnCodes; !bytes.Equal(rcs, []byte{1, 1}) {
+		t.Fatalf("return codes = %v, want [1 1]", rcs)
+	}
+}
+
+// fakeServer is the server side of a client connection used in tests,
+// closing the client closes the pipe on both ends.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+	enc  *Encoder
+	dec  *Decoder
 }
 
-func newClient(t *testing.T, opts ...Option) *Client {
+func newPipeClient(t *testing.T, opts ...Option) (*Client, *fakeServer) {
 	t.Helper()
-	addr := os.Getenv("TEST_MQTT_ADDR")
-	if addr == "" {
-		addr = ":1883"
+	cc, sc := net.Pipe()
+	s := &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+	return New(cc, opts...), s
+}
+
+func (s *fakeServer) send(pk packet.OutgoingPacket) {
+	s.t.Helper()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.enc.Encode(pk); err != nil {
+		s.t.Fatal(err)
 	}
-	conn, err := net.Dial("tcp", addr)
+}
+
+func (s *fakeServer) recv() packet.IncomingPacket {
+	s.t.Helper()
+	if err := s.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		s.t.Fatal(err)
+	}
+	pk, err := s.dec.Decode()
 	if err != nil {
-		t.Fatal(err)
+		s.t.Fatal(err)
+	}
+	return pk
+}
+
+func (s *fakeServer) expect(want packet.IncomingPacket) {
+	s.t.Helper()
+	if have := s.recv(); !reflect.DeepEqual(have, want) {
+		s.t.Fatalf("recv = %s, want %s", have, want)
+	}
+}
+
+func TestInvalidTopics(t *testing.T) {
+	c, _ := newPipeClient(t)
+	defer c.Close()
+
+	// nothing is sent, so the fake server doesn't have to read
+	if err := c.Publish(context.Background(), "a/+"); err == nil {
+		t.Error("publish error expected")
+	}
+	if _, err := c.Subscribe(context.Background(),
+		packet.WithSubscribeTopic("a/#/b", packet.QoS0),
+	); err == nil {
+		t.Error("subscribe error expected")
+	}
+	if err := c.Unsubscribe(context.Background(),
+		packet.WithUnsubscribeTopic("a+"),
+	); err == nil {
+		t.Error("unsubscribe error expected")
 	}
-	return New(conn, opts...)
 }
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -20,8 +21,15 @@ var (
 	usernameFlag     string
 	passwordFlag     string
 	keepAliveFlag    uint
+	protocolFlag     uint
 	debugFlag        bool
 
+	caFileFlag       string
+	certFlag         string
+	keyFlag          string
+	certPasswordFlag string
+	insecureFlag     bool
+
 	willTopicFlag   string
 	willPayloadFlag string
 	willQoSFlag     uint
@@ -36,13 +44,19 @@ Common Options:
 `, filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 	}
-	flag.StringVar(&addrFlag, "addr", ":1883", "address to connect to")
+	flag.StringVar(&addrFlag, "addr", "tcp://localhost:1883", "server URL, schemes are tcp, ssl, ws, wss and unix")
 	flag.BoolVar(&cleanSessionFlag, "clean-session", true, "clean session")
 	flag.StringVar(&clientIDFlag, "client-id", "", "client id")
 	flag.StringVar(&usernameFlag, "username", "", "username")
 	flag.StringVar(&passwordFlag, "password", "", "password")
 	flag.UintVar(&keepAliveFlag, "keep-alive", 0, "keep alive")
+	flag.UintVar(&protocolFlag, "protocol-level", packet.ProtocolLevel311, "protocol level, 4 for 3.1.1 and 5 for 5.0")
 	flag.BoolVar(&debugFlag, "debug", false, "enable debug mode")
+	flag.StringVar(&caFileFlag, "cafile", "", "PEM bundle of trusted CA certificates")
+	flag.StringVar(&certFlag, "cert", "", "client certificate PEM or PKCS#12 (.p12, .pfx) file")
+	flag.StringVar(&keyFlag, "key", "", "client private key PEM file")
+	flag.StringVar(&certPasswordFlag, "cert-password", "", "PKCS#12 file password")
+	flag.BoolVar(&insecureFlag, "insecure", false, "skip server certificate verification")
 	flag.StringVar(&willTopicFlag, "will-topic", "", "topic name to publish the will")
 	flag.StringVar(&willPayloadFlag, "will-payload", "", "payload of the client will")
 	flag.UintVar(&willQoSFlag, "will-qos", 0, "QoS level of the will")
@@ -81,11 +95,6 @@ func run() error {
 }
 
 func connect(ctx context.Context, opts ...mqtt.Option) (*mqtt.Client, error) {
-	conn, err := net.Dial("tcp", addrFlag)
-	if err != nil {
-		return nil, err
-	}
-
 	if debugFlag {
 		opts = append(opts,
 			mqtt.WithIncomingInterceptor(func(pk packet.IncomingPacket) {
@@ -97,23 +106,56 @@ func connect(ctx context.Context, opts ...mqtt.Option) (*mqtt.Client, error) {
 		)
 	}
 
-	c := mqtt.New(conn, opts...)
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, mqtt.WithTLSConfig(config))
+
 	copts := []packet.ConnectOption{
 		packet.WithConnectCleanSession(cleanSessionFlag),
 		packet.WithConnectClientID(clientIDFlag),
-		packet.WithConnectUsername(usernameFlag),
-		packet.WithConnectPassword(passwordFlag),
 		packet.WithConnectKeepAlive(uint16(keepAliveFlag)),
+		packet.WithConnectProtocolLevel(uint8(protocolFlag)),
+	}
+	// credentials can be passed in the URL as well
+	if usernameFlag != "" {
+		copts = append(copts, packet.WithConnectUsername(usernameFlag))
+	}
+	if passwordFlag != "" {
+		copts = append(copts, packet.WithConnectPassword(passwordFlag))
 	}
 	if willTopicFlag != "" {
 		copts = append(copts, packet.WithConnectWill(
 			willTopicFlag, []byte(willPayloadFlag), packet.QoS(willQoSFlag), willRetainFlag,
 		))
 	}
-	if _, err = c.Connect(ctx, copts...); err != nil {
-		return nil, err
+	return mqtt.Dial(ctx, addrFlag, append(opts,
+		mqtt.WithProxy(http.ProxyFromEnvironment),
+		mqtt.WithConnectOptions(copts...),
+	)...)
+}
+
+func tlsConfig() (*tls.Config, error) {
+	var opts []mqtt.TLSOption
+	if caFileFlag != "" {
+		opts = append(opts, mqtt.WithTLSCAFile(caFileFlag))
+	}
+	switch ext := filepath.Ext(certFlag); {
+	case certFlag == "":
+	case ext == ".p12" || ext == ".pfx":
+		opts = append(opts, mqtt.WithTLSPKCS12File(certFlag, certPasswordFlag))
+	default:
+		key := keyFlag
+		if key == "" {
+			key = certFlag // both in one file
+		}
+		opts = append(opts, mqtt.WithTLSCertFile(certFlag, key))
+	}
+	if insecureFlag {
+		opts = append(opts, mqtt.WithTLSInsecure())
 	}
-	return c, nil
+	return mqtt.NewTLSConfig(opts...)
 }
 
 type connectFunc func(ctx context.Context, opts ...mqtt.Option) (*mqtt.Client, error)
@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// conn is a single network connection to the server, clients created
+// with New use only one of them and clients with a dialer go through
+// a new one every time they reconnect.
+type conn struct {
+	rw     *encoderDecoder
+	outc   chan *out
+	done   chan struct{}
+	txdone chan struct{}
+	err    error
+	once   sync.Once
+	cerr   error // rw.Close result
+
+	connackc chan *packet.Connack
+	pingOnce sync.Once
+	lastTx   int64 // unix nano, accessed atomically
+
+	pmu  sync.Mutex
+	pong *pong // the ping in flight, nil when there's none
+}
+
+// pong is the result of a ping shared by all callers that
+// wait for it, so only one PINGREQ is in flight at a time.
+type pong struct {
+	done chan struct{}
+	err  error // set before done is closed when PINGREQ is not sent
+}
+
+type out struct {
+	pk   packet.OutgoingPacket
+	done chan struct{}
+
+	// sent is called by the transmitter right before writing the packet,
+	// it's used for tracking packets that are retransmitted on reconnect.
+	sent func()
+}
+
+func newConn(rw io.ReadWriteCloser) *conn {
+	return &conn{
+		rw:     newEncoderDecoder(rw),
+		outc:   make(chan *out),
+		done:   make(chan struct{}),
+		txdone: make(chan struct{}),
+
+		// the channel is buffered so the response is not lost
+		// when it arrives before the caller starts waiting
+		connackc: make(chan *packet.Connack, 1),
+	}
+}
+
+// send hands the packet over to the transmitter and waits until it's written,
+// lost reports that the connection has been closed before that.
+//
+// Packets with the sent hook are considered written as soon as
+// the transmitter takes them because they're retransmitted on reconnect.
+func (cn *conn) send(ctx context.Context, o *out) (lost bool, err error) {
+	select {
+	case cn.outc <- o:
+	case <-cn.done:
+		return true, cn.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if o.sent != nil {
+		return false, nil
+	}
+	select {
+	case <-o.done:
+		return false, nil
+	case <-cn.done:
+		return true, cn.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// close closes the connection, only the first error is recorded.
+func (cn *conn) close(err error) error {
+	cn.once.Do(func() {
+		cn.err = err
+		close(cn.done)
+		cn.cerr = cn.rw.Close()
+	})
+	return cn.cerr
+}
+
+// touch records the time of the last packet sent to the server.
+func (cn *conn) touch() {
+	atomic.StoreInt64(&cn.lastTx, time.Now().UnixNano())
+}
+
+func (cn *conn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&cn.lastTx)))
+}
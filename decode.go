@@ -4,16 +4,46 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 
 	"github.com/amenzhinsky/mqtt/packet"
 )
 
+// NewDecoder creates a decoder of client-bound packets.
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{dec: &dec{buf: &buffer{r: r}}}
+	return &Decoder{
+		dec:   &dec{buf: &buffer{r: r}},
+		level: packet.ProtocolLevel311,
+		new:   packet.NewIncomingPacket,
+	}
+}
+
+// NewServerDecoder creates a decoder of server-bound packets,
+// that is what brokers receive from clients.
+func NewServerDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		dec:   &dec{buf: &buffer{r: r}},
+		level: packet.ProtocolLevel311,
+		new: func(fh uint8) packet.IncomingPacket {
+			if pk := packet.NewServerBoundPacket(fh); pk != nil {
+				return pk
+			}
+			return nil
+		},
+	}
 }
 
 type Decoder struct {
-	dec *dec
+	dec   *dec
+	level uint32
+	new   func(fh uint8) packet.IncomingPacket
+}
+
+// SetProtocolLevel sets protocol version for packets decoded afterwards,
+// it's safe to call it concurrently with Decode, in this case it takes
+// effect for the packet that is being read.
+func (d *Decoder) SetProtocolLevel(level uint8) {
+	atomic.StoreUint32(&d.level, uint32(level))
 }
 
 func (d *Decoder) Decode() (packet.IncomingPacket, error) {
@@ -22,11 +52,12 @@ func (d *Decoder) Decode() (packet.IncomingPacket, error) {
 	if err != nil {
 		return nil, err
 	}
+	d.dec.level = uint8(atomic.LoadUint32(&d.level))
 	if err = d.dec.readLenAndGrow(); err != nil {
 		return nil, err
 	}
 
-	pk := packet.NewIncomingPacket(h)
+	pk := d.new(h)
 	if pk == nil {
 		return nil, fmt.Errorf("unknown packet type 0x%x", h>>4)
 	}
@@ -40,8 +71,17 @@ func (d *Decoder) Decode() (packet.IncomingPacket, error) {
 }
 
 type dec struct {
-	buf *buffer
-	len int
+	buf   *buffer
+	len   int
+	level uint8
+}
+
+func (d *dec) ProtocolLevel() uint8 {
+	return d.level
+}
+
+func (d *dec) Len() int {
+	return d.len
 }
 
 func (d *dec) Bits() (byte, error) {
@@ -72,6 +112,39 @@ func (d *dec) Integer() (uint16, error) {
 	return uint16(b2) | uint16(b1)<<8, nil
 }
 
+func (d *dec) Integer32() (uint32, error) {
+	if err := d.checkAvailableBytes(4); err != nil {
+		return 0, err
+	}
+	b, err := d.buf.Bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	d.len -= 4
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
+
+func (d *dec) VarInt() (uint32, error) {
+	const maxMul = 128 * 128 * 128
+
+	m := 1
+	v := 0
+	for {
+		b, err := d.Bits()
+		if err != nil {
+			return 0, err
+		}
+		v += int(b&127) * m
+		if b&128 == 0 {
+			return uint32(v), nil
+		}
+		m *= 128
+		if m > maxMul {
+			return 0, errors.New("malformed variable byte integer")
+		}
+	}
+}
+
 func (d *dec) Payload() ([]byte, error) {
 	if err := d.checkAvailableBytes(d.len); err != nil {
 		return nil, err
@@ -105,7 +178,7 @@ func (d *dec) Bytes() ([]byte, error) {
 func (d *dec) String() (string, error) {
 	b, err := d.Bytes()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return string(b), nil
 }
@@ -138,13 +211,13 @@ func (d *dec) readLen() (int, error) {
 			return 0, err
 		}
 		v += int(b&127) * m
+		if b&128 == 0 {
+			return v, nil
+		}
 		m *= 128
 		if m > maxMul {
 			return 0, errors.New("malformed length")
 		}
-		if b&128 == 0 {
-			return v, nil
-		}
 	}
 }
 
@@ -188,11 +261,11 @@ func (b *buffer) Grow(size int) error {
 			capacity = 4096
 		}
 		n := make([]byte, capacity)
-		b.end = copy(n, b.buf[b.off:])
+		b.end = copy(n, b.buf[b.off:b.end])
 		b.off = 0
 		b.buf = n
 	} else if size > len(b.buf)-b.off {
-		b.end = copy(b.buf, b.buf[b.off:])
+		b.end = copy(b.buf, b.buf[b.off:b.end])
 		b.off = 0
 	}
 
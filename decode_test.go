@@ -0,0 +1,314 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestDecodeV5(t *testing.T) {
+	for _, run := range []struct {
+		name string
+		b    []byte
+		want packet.IncomingPacket
+	}{
+		{
+			"connack",
+			[]byte{0x20, 0x08, 0x01, 0x00, 0x05, 0x21, 0x00, 0x0a, 0x25, 0x01},
+			&packet.Connack{
+				Flags:            0x20,
+				AcknowledgeFlags: packet.AcknowledgeSessionPresent,
+				Properties: packet.Properties{
+					ReceiveMaximum:  packet.Uint16(10),
+					RetainAvailable: packet.Uint8(1),
+				},
+			},
+		},
+		{
+			"connack failure",
+			[]byte{0x20, 0x03, 0x00, 0x87, 0x00},
+			&packet.Connack{
+				Flags:      0x20,
+				ReturnCode: packet.ConnectionNotAuthorized,
+				ReasonCode: packet.NotAuthorized,
+			},
+		},
+		{
+			"connack 3.1.1 fallback",
+			[]byte{0x20, 0x02, 0x00, 0x01},
+			&packet.Connack{
+				Flags:      0x20,
+				ReturnCode: packet.ConnectionUnacceptableProtocolVersion,
+			},
+		},
+		{
+			"puback short",
+			[]byte{0x40, 0x02, 0x00, 0x07},
+			&packet.Puback{Flags: 0x40, PacketID: 7},
+		},
+		{
+			"puback reason",
+			[]byte{0x40, 0x03, 0x00, 0x07, 0x10},
+			&packet.Puback{Flags: 0x40, PacketID: 7, ReasonCode: packet.NoMatchingSubscribers},
+		},
+		{
+			"suback",
+			[]byte{0x90, 0x05, 0x00, 0x01, 0x00, 0x01, 0x8f},
+			&packet.Suback{Flags: 0x90, PacketID: 1, ReturnCodes: []uint8{0x01, 0x8f}},
+		},
+		{
+			"unsuback",
+			[]byte{0xb0, 0x04, 0x00, 0x02, 0x00, 0x11},
+			&packet.Unsuback{Flags: 0xb0, PacketID: 2, ReasonCodes: []uint8{0x11}},
+		},
+		{
+			"disconnect",
+			[]byte{0xe0, 0x01, 0x8b},
+			&packet.Disconnect{Flags: 0xe0, ReasonCode: packet.ServerShuttingDown},
+		},
+	} {
+		t.Run(run.name, func(t *testing.T) {
+			d := NewDecoder(bytes.NewReader(run.b))
+			d.SetProtocolLevel(packet.ProtocolLevel5)
+			have, err := d.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, run.want) {
+				t.Errorf("Decode() = %#v, want %#v", have, run.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReusedBuffer(t *testing.T) {
+	var b bytes.Buffer
+	e := NewEncoder(&b)
+	e.SetProtocolLevel(packet.ProtocolLevel5)
+	for _, pk := range []packet.Packet{
+		packet.NewUnsuback(1, packet.WithUnsubackReasonCodes(0, 0)),
+		packet.NewSuback(2, packet.WithSubackReturnCodes(1, 1)),
+		packet.NewPublish("a", packet.WithPublishPayload(bytes.Repeat([]byte{0xee}, 4080))),
+	} {
+		if err := e.Encode(pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// acknowledgements stay intact when the decoder reads next packets
+	d := NewDecoder(&b)
+	d.SetProtocolLevel(packet.ProtocolLevel5)
+	var pks []packet.IncomingPacket
+	for i := 0; i < 3; i++ {
+		pk, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks = append(pks, pk)
+	}
+	if rcs := pks[0].(*packet.Unsuback).ReasonCodes; !bytes.Equal(rcs, []byte{0, 0}) {
+		t.Errorf("unsuback reason codes = %v, want [0 0]", rcs)
+	}
+	if rcs := pks[1].(*packet.Suback).ReturnCodes; !bytes.Equal(rcs, []byte{1, 1}) {
+		t.Errorf("suback return codes = %v, want [1 1]", rcs)
+	}
+}
+
+func TestDecodeGrow(t *testing.T) {
+	var chunks []io.Reader
+	want := packet.NewPublish("a", packet.WithPublishPayload(bytes.Repeat([]byte{0xee}, 8000)))
+	for _, pk := range []packet.Packet{
+		packet.NewPublish("a", packet.WithPublishPayload(make([]byte, 3994))),
+		packet.NewPublish("a", packet.WithPublishPayload(make([]byte, 194))),
+		want,
+	} {
+		var b bytes.Buffer
+		if err := NewEncoder(&b).Encode(pk); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, &b)
+	}
+
+	// the header of the last packet is read separately, so the buffer
+	// is grown when it has unused bytes left from previous packets
+	last := chunks[2].(*bytes.Buffer)
+	chunks[2] = bytes.NewReader(last.Next(5))
+	chunks = append(chunks, last)
+
+	d := NewDecoder(io.MultiReader(chunks...))
+	var have packet.IncomingPacket
+	for i := 0; i < 3; i++ {
+		var err error
+		if have, err = d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("Decode() = %s, want %s", have, want)
+	}
+}
+
+func TestEncodeDecodeV5Publish(t *testing.T) {
+	want := packet.NewPublish("a/b",
+		packet.WithPublishQoS(packet.QoS1),
+		packet.WithPublishPacketID(10),
+		packet.WithPublishPayload([]byte("payload")),
+		packet.WithPublishProperties(packet.Properties{
+			PayloadFormatIndicator:  packet.Uint8(1),
+			MessageExpiryInterval:   packet.Uint32(60),
+			ContentType:             "text/plain",
+			ResponseTopic:           "a/c",
+			CorrelationData:         []byte{1, 2, 3},
+			SubscriptionIdentifiers: []uint32{1, 300000},
+			UserProperties: []packet.UserProperty{
+				{Key: "k", Value: "v1"},
+				{Key: "k", Value: "v2"},
+			},
+		}),
+	)
+
+	var b bytes.Buffer
+	e := NewEncoder(&b)
+	e.SetProtocolLevel(packet.ProtocolLevel5)
+	if err := e.Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(&b)
+	d.SetProtocolLevel(packet.ProtocolLevel5)
+	have, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("Decode() = %#v, want %#v", have, want)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	props := packet.Properties{
+		ReasonString:   "reason",
+		UserProperties: []packet.UserProperty{{Key: "k", Value: "v"}},
+	}
+	for _, level := range []uint8{packet.ProtocolLevel311, packet.ProtocolLevel5} {
+		for _, run := range []struct {
+			server bool
+			pk     packet.Packet
+			v5     packet.Packet // overrides pk for MQTT 5.0
+		}{
+			{true, packet.NewConnect(
+				packet.WithConnectProtocolLevel(level),
+				packet.WithConnectClientID("id"),
+				packet.WithConnectCleanSession(true),
+				packet.WithConnectKeepAlive(10),
+				packet.WithConnectWill("will", []byte("bye"), packet.QoS1, true),
+				packet.WithConnectUsername("user"),
+				packet.WithConnectPassword("pass"),
+			), packet.NewConnect(
+				packet.WithConnectProtocolLevel(level),
+				packet.WithConnectClientID("id"),
+				packet.WithConnectWill("will", []byte("bye"), packet.QoS2, false),
+				packet.WithConnectProperties(packet.Properties{
+					SessionExpiryInterval: packet.Uint32(10),
+				}),
+				packet.WithConnectWillProperties(packet.Properties{
+					WillDelayInterval: packet.Uint32(5),
+				}),
+			)},
+			{false, packet.NewConnack(
+				packet.WithConnackSessionPresent(true),
+				packet.WithConnackReturnCode(packet.ConnectionAccepted),
+			), packet.NewConnack(
+				packet.WithConnackSessionPresent(true),
+				packet.WithConnackProperties(packet.Properties{
+					AssignedClientIdentifier: "auto",
+					MaximumQoS:               packet.Uint8(1),
+				}),
+			)},
+			{true, packet.NewPublish("a/b",
+				packet.WithPublishQoS(packet.QoS2),
+				packet.WithPublishPacketID(1),
+				packet.WithPublishPayload([]byte("payload")),
+			), nil},
+			{false, packet.NewPublish("a/b",
+				packet.WithPublishPayload([]byte("payload")),
+			), nil},
+			{true, packet.NewPuback(2), packet.NewPuback(2,
+				packet.WithPubackReasonCode(packet.NotAuthorized),
+				packet.WithPubackProperties(props),
+			)},
+			{false, packet.NewPuback(2), nil},
+			{true, packet.NewPubrec(3), packet.NewPubrec(3,
+				packet.WithPubrecReasonCode(packet.QuotaExceeded),
+			)},
+			{false, packet.NewPubrec(3), nil},
+			{true, packet.NewPubrel(4), packet.NewPubrel(4,
+				packet.WithPubrelReasonCode(packet.PacketIdentifierNotFound),
+			)},
+			{true, packet.NewPubcomp(5), packet.NewPubcomp(5,
+				packet.WithPubcompProperties(props),
+			)},
+			{false, packet.NewPubcomp(5), nil},
+			{true, packet.NewSubscribe(
+				packet.WithSubscribePacketID(6),
+				packet.WithSubscribeTopic("a/#", packet.QoS1),
+				packet.WithSubscribeTopic("b/+", packet.QoS2),
+			), packet.NewSubscribe(
+				packet.WithSubscribePacketID(6),
+				packet.WithSubscribeTopicFlags("a/#", packet.QoS1|packet.SubscribeNoLocal),
+				packet.WithSubscribeProperties(packet.Properties{
+					SubscriptionIdentifiers: []uint32{1},
+				}),
+			)},
+			{false, packet.NewSuback(6,
+				packet.WithSubackReturnCodes(packet.SubscriptionMaxQoS1, packet.SubscriptionFailure),
+			), packet.NewSuback(6,
+				packet.WithSubackReturnCodes(uint8(packet.GrantedQoS1)),
+				packet.WithSubackProperties(props),
+			)},
+			{true, packet.NewUnsubscribe(
+				packet.WithUnsubscribePacketID(7),
+				packet.WithUnsubscribeTopic("a/#", "b/+"),
+			), nil},
+			{false, packet.NewUnsuback(7), packet.NewUnsuback(7,
+				packet.WithUnsubackReasonCodes(uint8(packet.Success), uint8(packet.NoSubscriptionExisted)),
+			)},
+			{true, packet.NewPingreq(), nil},
+			{false, packet.NewPingresp(), nil},
+			{true, packet.NewDisconnect(), packet.NewDisconnect(
+				packet.WithDisconnectReasonCode(packet.DisconnectWithWillMessage),
+			)},
+		} {
+			want := run.pk
+			if level == packet.ProtocolLevel5 && run.v5 != nil {
+				want = run.v5
+			}
+			t.Run(fmt.Sprintf("%d %s", level, want), func(t *testing.T) {
+				var b bytes.Buffer
+				e := NewEncoder(&b)
+				e.SetProtocolLevel(level)
+				if err := e.Encode(want); err != nil {
+					t.Fatal(err)
+				}
+
+				var d *Decoder
+				if run.server {
+					d = NewServerDecoder(&b)
+				} else {
+					d = NewDecoder(&b)
+				}
+				d.SetProtocolLevel(level)
+				have, err := d.Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(have, want) {
+					t.Errorf("Decode() = %#v, want %#v", have, want)
+				}
+			})
+		}
+	}
+}
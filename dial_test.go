@@ -0,0 +1,156 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestDial(t *testing.T) {
+	l, servers := listen(t, "tcp", "127.0.0.1:0", nil)
+	defer l.Close()
+
+	c, err := dialTest(t, servers, "mqtt://user:pass@"+l.Addr().String(), func(connect *packet.Connect) {
+		if connect.Username != "user" || connect.Password != "pass" {
+			t.Errorf("credentials = %q:%q, want %q:%q", connect.Username, connect.Password, "user", "pass")
+		}
+		if connect.ClientID != "test" {
+			t.Errorf("client id = %q, want %q", connect.ClientID, "test")
+		}
+	}, WithConnectOptions(packet.WithConnectClientID("test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, servers := listen(t, "unix", filepath.Join(dir, "mqtt.sock"), nil)
+	defer l.Close()
+	c, err := dialTest(t, servers, "unix://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestDialProxy(t *testing.T) {
+	l, servers := listen(t, "tcp", "127.0.0.1:0", func(conn net.Conn) bool {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		if req.Method != http.MethodConnect || req.Host != "example.com:1883" {
+			t.Errorf("request = %s %s, want CONNECT example.com:1883", req.Method, req.Host)
+		}
+		if user, pass, _ := (&http.Request{Header: http.Header{
+			"Authorization": req.Header["Proxy-Authorization"],
+		}}).BasicAuth(); user != "proxy" || pass != "secret" {
+			t.Errorf("proxy credentials = %q:%q, want %q:%q", user, pass, "proxy", "secret")
+		}
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return err == nil
+	})
+	defer l.Close()
+
+	proxy := &url.URL{Scheme: "http", User: url.UserPassword("proxy", "secret"), Host: l.Addr().String()}
+	c, err := dialTest(t, servers, "tcp://example.com", nil, WithProxy(http.ProxyURL(proxy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestDialURL(t *testing.T) {
+	for rawurl, want := range map[string]string{
+		"example.com:1884":          "tcp example.com:1884",
+		"tcp://example.com":         "tcp example.com:1883",
+		"mqtt://:1884":              "tcp localhost:1884",
+		"ssl://example.com":         "tcp example.com:8883",
+		"mqtts://example.com:8884":  "tcp example.com:8884",
+		"ws://example.com/mqtt":     "tcp example.com:80",
+		"wss://example.com/mqtt":    "tcp example.com:443",
+		"unix:///var/run/mqtt.sock": "unix /var/run/mqtt.sock",
+		"udp://example.com":         "",
+		"unix://":                   "",
+	} {
+		d, err := newURLDialer(rawurl, nil, nil)
+		if err != nil {
+			if want != "" {
+				t.Errorf("newURLDialer(%q) error: %s", rawurl, err)
+			}
+			continue
+		}
+		if have := d.network + " " + d.addr; have != want {
+			t.Errorf("newURLDialer(%q) = %q, want %q", rawurl, have, want)
+		}
+	}
+}
+
+// listen accepts connections and passes them to the returned channel,
+// handshake is called first when it's not nil.
+func listen(t *testing.T, network, addr string, handshake func(net.Conn) bool) (net.Listener, <-chan *fakeServer) {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, accept(t, l, handshake)
+}
+
+// accept passes connections accepted by l to the returned channel.
+func accept(t *testing.T, l net.Listener, handshake func(net.Conn) bool) <-chan *fakeServer {
+	servers := make(chan *fakeServer, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if handshake != nil && !handshake(conn) {
+				conn.Close()
+				continue
+			}
+			servers <- &fakeServer{t: t, conn: conn, enc: NewEncoder(conn), dec: NewServerDecoder(conn)}
+		}
+	}()
+	return servers
+}
+
+func dialTest(
+	t *testing.T, servers <-chan *fakeServer, rawurl string, check func(*packet.Connect), opts ...Option,
+) (*Client, error) {
+	t.Helper()
+	type result struct {
+		c   *Client
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		c, err := Dial(context.Background(), rawurl, opts...)
+		resc <- result{c, err}
+	}()
+	s := <-servers
+	connect := s.expectConnect()
+	if check != nil {
+		check(connect)
+	}
+	s.send(packet.NewConnack())
+	res := <-resc
+	return res.c, res.err
+}
@@ -3,53 +3,77 @@ package mqtt
 import (
 	"errors"
 	"io"
+	"sync/atomic"
 	"unicode/utf8"
 
 	"github.com/amenzhinsky/mqtt/packet"
 )
 
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: w}
+	return &Encoder{w: w, level: packet.ProtocolLevel311}
 }
 
 type Encoder struct {
-	w io.Writer
-	b enc
+	w     io.Writer
+	b     enc
+	level uint32
+}
+
+// SetProtocolLevel sets protocol version for packets encoded afterwards,
+// packet.ProtocolLevel311 is the default one.
+func (e *Encoder) SetProtocolLevel(level uint8) {
+	atomic.StoreUint32(&e.level, uint32(level))
 }
 
 func (e *Encoder) Encode(pk packet.OutgoingPacket) error {
 	e.b.reset()
-	e.b = append(e.b, byte(pk.GetFlags()))
+	e.b.level = uint8(atomic.LoadUint32(&e.level))
+	e.b.buf = append(e.b.buf, byte(pk.GetFlags()))
 	var err error
 	if err = pk.Encode(&e.b); err != nil {
 		return err
 	}
-	_, err = e.w.Write(e.b)
+	_, err = e.w.Write(e.b.buf)
 	return err
 }
 
-type enc []byte
+type enc struct {
+	buf   []byte
+	level uint8
+}
 
 func (e *enc) reset() {
-	if e == nil {
-		*e = make([]byte, 0, 4096)
+	if e.buf == nil {
+		e.buf = make([]byte, 0, 4096)
 	} else {
-		*e = (*e)[:0]
+		e.buf = e.buf[:0]
 	}
 }
 
+func (e *enc) ProtocolLevel() uint8 {
+	return e.level
+}
+
+const maxVarInt = 1024*1024*256 - 1 // 256MB
+
 func (e *enc) Len(n int) error {
-	const maxLen = 1024*1024*256 - 1 // 256MB
-	if n > maxLen {
+	if n > maxVarInt {
 		return errors.New("length is too big")
 	}
-	for i := 1; ; i++ {
+	return e.VarInt(uint32(n))
+}
+
+func (e *enc) VarInt(n uint32) error {
+	if n > maxVarInt {
+		return errors.New("variable byte integer is too big")
+	}
+	for {
 		c := uint8(n % 128)
 		n /= 128
 		if n > 0 {
 			c |= 128
 		}
-		*e = append(*e, c)
+		e.buf = append(e.buf, c)
 		if n == 0 {
 			return nil
 		}
@@ -57,17 +81,22 @@ func (e *enc) Len(n int) error {
 }
 
 func (e *enc) Bits(c uint8) error {
-	*e = append(*e, c)
+	e.buf = append(e.buf, c)
 	return nil
 }
 
 func (e *enc) Integer(n uint16) error {
-	*e = append(*e, uint8(n>>8), uint8(n))
+	e.buf = append(e.buf, uint8(n>>8), uint8(n))
+	return nil
+}
+
+func (e *enc) Integer32(n uint32) error {
+	e.buf = append(e.buf, uint8(n>>24), uint8(n>>16), uint8(n>>8), uint8(n))
 	return nil
 }
 
 func (e *enc) Payload(b []byte) error {
-	*e = append(*e, b...)
+	e.buf = append(e.buf, b...)
 	return nil
 }
 
@@ -80,7 +109,7 @@ func (e *enc) Bytes(b []byte) error {
 	if err := e.Integer(uint16(len(b))); err != nil {
 		return err
 	}
-	*e = append(*e, b...)
+	e.buf = append(e.buf, b...)
 	return nil
 }
 
@@ -94,6 +123,6 @@ func (e *enc) String(s string) error {
 	if err := e.Integer(uint16(len(s))); err != nil {
 		return err
 	}
-	*e = append(*e, s...)
+	e.buf = append(e.buf, s...)
 	return nil
 }
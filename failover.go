@@ -0,0 +1,216 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// ServerReporter is an optional interface for dialers that choose
+// between multiple servers, the client reports to it results of
+// connection attempts made over connections returned by Dial.
+type ServerReporter interface {
+	// Report is called with nil error when the server is available, even if
+	// it rejects the connection for other reasons, and with the failure
+	// cause when the server is unavailable, it returns
+	// true when the client should dial another server right away
+	// instead of waiting for the next reconnection attempt.
+	Report(rw io.ReadWriteCloser, err error) bool
+}
+
+// FailoverOption is a Failover configuration option.
+type FailoverOption func(f *Failover)
+
+// WithFailoverRandom makes the dialer try servers in random order,
+// the order is shuffled every time all servers have been tried.
+func WithFailoverRandom() FailoverOption {
+	return func(f *Failover) {
+		f.random = true
+	}
+}
+
+// WithFailoverCooldown enables health-aware selection, servers that
+// failed are skipped for the given duration unless all of them failed.
+func WithFailoverCooldown(d time.Duration) FailoverOption {
+	return func(f *Failover) {
+		f.cooldown = d
+	}
+}
+
+// WithFailoverDialFunc sets the function for dialing single addresses,
+// by default addresses are dialed over TCP.
+func WithFailoverDialFunc(
+	fn func(ctx context.Context, addr string) (io.ReadWriteCloser, error),
+) FailoverOption {
+	return func(f *Failover) {
+		f.dial = fn
+	}
+}
+
+// NewFailover creates a dialer that connects to the first available
+// address in the list and switches to the next one when dialing fails,
+// the server is unreachable or it responds with server unavailable CONNACK.
+//
+// Every new connection starts with the first address unless the order
+// is random, so that the client gets back to preferred servers.
+func NewFailover(addrs []string, opts ...FailoverOption) *Failover {
+	f := &Failover{
+		servers: make([]*server, 0, len(addrs)),
+		dial:    dialTCP,
+		now:     time.Now,
+	}
+	for _, addr := range addrs {
+		f.servers = append(f.servers, &server{addr: addr})
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Failover is a Dialer that fails over between multiple servers.
+type Failover struct {
+	mu       sync.Mutex
+	servers  []*server
+	order    []*server // servers not tried yet in the current round
+	random   bool
+	cooldown time.Duration
+	dial     func(ctx context.Context, addr string) (io.ReadWriteCloser, error)
+	now      func() time.Time
+}
+
+type server struct {
+	addr     string
+	failures int
+	failedAt time.Time
+}
+
+// failoverConn remembers the server it's connected to.
+type failoverConn struct {
+	io.ReadWriteCloser
+	server *server
+}
+
+func dialTCP(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Dial connects to the next server in the current round,
+// it returns an error when none of them can be dialed.
+func (f *Failover) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	if len(f.servers) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+
+	var errs []string
+	for {
+		s, last := f.next()
+		rw, err := f.dial(ctx, s.addr)
+		if err == nil {
+			return &failoverConn{ReadWriteCloser: rw, server: s}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		f.fail(s)
+		errs = append(errs, err.Error())
+		if last {
+			return nil, fmt.Errorf("all addresses failed: %v", errs)
+		}
+	}
+}
+
+// next pops the next server to try, last reports
+// that it's the last one in the current round.
+func (f *Failover) next() (s *server, last bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.order) == 0 {
+		f.order = f.round()
+	}
+	s, f.order = f.order[0], f.order[1:]
+	return s, len(f.order) == 0
+}
+
+// round returns servers in the order they have to be tried,
+// healthy ones go first when cooldown is enabled.
+func (f *Failover) round() []*server {
+	order := make([]*server, len(f.servers))
+	copy(order, f.servers)
+	if f.random {
+		rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	if f.cooldown == 0 {
+		return order
+	}
+	now := f.now()
+	healthy := make([]*server, 0, len(order))
+	var failed []*server
+	for _, s := range order {
+		if s.failures != 0 && now.Sub(s.failedAt) < f.cooldown {
+			failed = append(failed, s)
+		} else {
+			healthy = append(healthy, s)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (f *Failover) fail(s *server) {
+	f.mu.Lock()
+	s.failures++
+	s.failedAt = f.now()
+	f.mu.Unlock()
+}
+
+// Report implements ServerReporter.
+func (f *Failover) Report(rw io.ReadWriteCloser, err error) bool {
+	fc, ok := rw.(*failoverConn)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		f.fail(fc.server)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.order) != 0
+	}
+
+	// start over from the preferred server next time
+	f.mu.Lock()
+	fc.server.failures = 0
+	f.order = nil
+	f.mu.Unlock()
+	return false
+}
+
+// serverUnavailable reports whether the connection attempt failed
+// because of the server and connecting to another one may succeed.
+func serverUnavailable(connack *packet.Connack) bool {
+	if connack == nil {
+		return true // connection or protocol error
+	}
+	if connack.ReasonCode == packet.Success {
+		// MQTT 3.1.1 servers respond with return codes only
+		return connack.ReturnCode == packet.ConnectionServerUnavailable
+	}
+
+	// return codes of MQTT 5.0 packets are derived from reason codes
+	// and report unknown reasons as server unavailable
+	switch connack.ReasonCode {
+	case packet.ServerUnavailable, packet.ServerBusy, packet.ServerShuttingDown,
+		packet.UseAnotherServer, packet.ServerMoved:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestFailover(t *testing.T) {
+	servers := make(chan *fakeServer, 1)
+	var dialed []string
+	f := NewFailover([]string{"a", "b", "c"},
+		WithFailoverDialFunc(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+			dialed = append(dialed, addr)
+			if addr == "a" {
+				return nil, errors.New("connection refused")
+			}
+			cc, sc := net.Pipe()
+			servers <- &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+			return cc, nil
+		}),
+	)
+	c := NewWithDialer(f, WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond}))
+	defer c.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background())
+		errc <- err
+	}()
+
+	s := <-servers // b
+	s.expectConnect()
+	s.send(packet.NewConnack(packet.WithConnackReturnCode(packet.ConnectionServerUnavailable)))
+	s = <-servers // c
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("dialed = %v, want %v", dialed, want)
+	}
+
+	// connection is lost, the next round starts over
+	s.conn.Close()
+	s = <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if want := []string{"a", "b", "c", "a", "b"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("dialed = %v, want %v", dialed, want)
+	}
+}
+
+func TestFailoverRejected(t *testing.T) {
+	var dialed []string
+	f := NewFailover([]string{"a", "b", "c"},
+		WithFailoverDialFunc(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+			dialed = append(dialed, addr)
+			cc, sc := net.Pipe()
+			s := &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+			rc := packet.ConnectionNotAuthorized
+			if addr == "a" {
+				rc = packet.ConnectionServerUnavailable
+			}
+			go func() {
+				s.expectConnect()
+				s.send(packet.NewConnack(packet.WithConnackReturnCode(rc)))
+			}()
+			return cc, nil
+		}),
+	)
+	c := NewWithDialer(f)
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Connect(context.Background()); err == nil {
+			t.Fatal("error expected")
+		}
+	}
+
+	// b is available, so the second attempt starts over from a
+	if want := []string{"a", "b", "a", "b"}; !reflect.DeepEqual(dialed, want) {
+		t.Fatalf("dialed = %v, want %v", dialed, want)
+	}
+}
+
+func TestServerUnavailable(t *testing.T) {
+	for _, run := range []struct {
+		connack *packet.Connack
+		want    bool
+	}{
+		{nil, true},
+		{&packet.Connack{ReturnCode: packet.ConnectionServerUnavailable}, true},
+		{&packet.Connack{ReturnCode: packet.ConnectionNotAuthorized}, false},
+		{&packet.Connack{
+			ReasonCode: packet.ServerBusy,
+			ReturnCode: packet.ConnectionServerUnavailable,
+		}, true},
+		{&packet.Connack{
+			ReasonCode: packet.QuotaExceeded,
+			ReturnCode: packet.ConnectionServerUnavailable,
+		}, false},
+	} {
+		if have := serverUnavailable(run.connack); have != run.want {
+			t.Errorf("serverUnavailable(%v) = %t, want %t", run.connack, have, run.want)
+		}
+	}
+}
+
+func TestFailoverCooldown(t *testing.T) {
+	now := time.Now()
+	down := map[string]bool{"a": true}
+	var dialed []string
+	f := NewFailover([]string{"a", "b"},
+		WithFailoverCooldown(time.Minute),
+		WithFailoverDialFunc(func(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+			dialed = append(dialed, addr)
+			if down[addr] {
+				return nil, errors.New("connection refused")
+			}
+			cc, _ := net.Pipe()
+			return cc, nil
+		}),
+	)
+	f.now = func() time.Time { return now }
+
+	dial := func(want ...string) {
+		t.Helper()
+		dialed = nil
+		rw, err := f.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Report(rw, nil)
+		rw.Close()
+		if !reflect.DeepEqual(dialed, want) {
+			t.Fatalf("dialed = %v, want %v", dialed, want)
+		}
+	}
+	dial("a", "b")
+	dial("b") // a is cooling down
+
+	now = now.Add(time.Minute)
+	down["a"] = false
+	dial("a")
+}
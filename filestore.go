@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/internal/atomicfile"
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// NewFileStore creates a store that keeps every packet in a separate file
+// in the given directory, files are replaced atomically so the store stays
+// consistent when the process crashes in the middle of writing.
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &fileStore{dir: dir}
+
+	// continue numbering after the latest stored packet
+	for _, dir := range []Direction{Outgoing, Incoming} {
+		recs, err := s.records(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recs {
+			if r.seq > s.seq {
+				s.seq = r.seq
+			}
+		}
+	}
+	return s, nil
+}
+
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+	seq uint64
+}
+
+func (s *fileStore) name(dir Direction, id uint16) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s-%05d", dir, id))
+}
+
+func (s *fileStore) Put(dir Direction, id uint16, pk packet.Packet) error {
+	b, err := marshalPacket(pk)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], s.seq)
+	return atomicfile.Write(s.name(dir, id), append(seq[:], b...))
+}
+
+func (s *fileStore) Delete(dir Direction, id uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.name(dir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Load(dir Direction) ([]packet.Packet, error) {
+	s.mu.Lock()
+	recs, err := s.records(dir)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalRecords(dir, recs)
+}
+
+func (s *fileStore) records(dir Direction) ([]*record, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := dir.String() + "-"
+	var recs []*record
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), prefix) || strings.HasSuffix(fi.Name(), atomicfile.TmpSuffix) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 8 {
+			return nil, fmt.Errorf("corrupted file %q", fi.Name())
+		}
+		recs = append(recs, &record{seq: binary.BigEndian.Uint64(b), b: b[8:]})
+	}
+	return recs, nil
+}
+
+func (s *fileStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasPrefix(name, Outgoing.String()+"-") ||
+			strings.HasPrefix(name, Incoming.String()+"-") {
+			if err = os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
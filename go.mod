@@ -1,3 +1,7 @@
 module github.com/amenzhinsky/mqtt
 
-go 1.12
+go 1.19
+
+require software.sslmate.com/src/go-pkcs12 v0.4.0
+
+require golang.org/x/crypto v0.11.0 // indirect
@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+var (
+	errPacketIDInUse = errors.New("packet id is in use")
+	errClosed        = errors.New("closed")
+)
+
+// inflight correlates acknowledgements received from the server
+// with operations waiting for them by packet identifiers,
+// it also allocates identifiers that are not in use and keeps
+// packets that have to be retransmitted on reconnect.
+type inflight struct {
+	mu    sync.Mutex
+	m     map[uint16]*flight
+	last  uint16
+	seq   uint64
+	freec chan struct{} // closed when an id is released and someone is waiting for it
+}
+
+type flight struct {
+	ackc chan packet.IncomingPacket
+	pk   packet.OutgoingPacket // the last sent packet that is not acknowledged yet
+	seq  uint64                // the order pk has been sent in
+}
+
+func newInflight() *inflight {
+	return &inflight{m: make(map[uint16]*flight)}
+}
+
+const maxPacketIDs = 1<<16 - 1 // zero is not a valid id
+
+// alloc registers a free non-zero packet id, when all of them are in use
+// it blocks until one is released, ctx is done or the done channel is closed
+// that is reported as errClosed.
+func (f *inflight) alloc(
+	ctx context.Context, done <-chan struct{},
+) (uint16, <-chan packet.IncomingPacket, error) {
+	for {
+		f.mu.Lock()
+		if len(f.m) < maxPacketIDs {
+			id := f.last
+			for {
+				id++
+				if id == 0 {
+					continue
+				}
+				if _, ok := f.m[id]; !ok {
+					break
+				}
+			}
+			f.last = id
+			ackc := f.register(id)
+			f.mu.Unlock()
+			return id, ackc, nil
+		}
+		if f.freec == nil {
+			f.freec = make(chan struct{})
+		}
+		freec := f.freec
+		f.mu.Unlock()
+
+		select {
+		case <-freec:
+		case <-done:
+			return 0, nil, errClosed
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// add registers the given packet id and returns the channel acknowledgements
+// are delivered to, the id has to be released with delete when the flow is done.
+func (f *inflight) add(id uint16) (<-chan packet.IncomingPacket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id == 0 {
+		return nil, errors.New("packet id must be non-zero")
+	}
+	if _, ok := f.m[id]; ok {
+		return nil, errPacketIDInUse
+	}
+	return f.register(id), nil
+}
+
+func (f *inflight) register(id uint16) chan packet.IncomingPacket {
+	// QoS 2 flows receive two packets but never at once
+	ackc := make(chan packet.IncomingPacket, 1)
+	f.m[id] = &flight{ackc: ackc}
+	return ackc
+}
+
+// track remembers the packet sent for the given id
+// to retransmit it until it's acknowledged.
+func (f *inflight) track(id uint16, pk packet.OutgoingPacket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl, ok := f.m[id]; ok {
+		f.seq++
+		fl.pk = pk
+		fl.seq = f.seq
+	}
+}
+
+// pending returns tracked packets in the order they have been sent.
+func (f *inflight) pending() []packet.OutgoingPacket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fls := make([]*flight, 0, len(f.m))
+	for _, fl := range f.m {
+		if fl.pk != nil {
+			fls = append(fls, fl)
+		}
+	}
+	sort.Slice(fls, func(i, j int) bool {
+		return fls[i].seq < fls[j].seq
+	})
+	pks := make([]packet.OutgoingPacket, 0, len(fls))
+	for _, fl := range fls {
+		pks = append(pks, fl.pk)
+	}
+	return pks
+}
+
+// delete releases the packet id making it available for allocation.
+func (f *inflight) delete(id uint16) {
+	f.mu.Lock()
+	delete(f.m, id)
+	if f.freec != nil {
+		close(f.freec)
+		f.freec = nil
+	}
+	f.mu.Unlock()
+}
+
+// deliver passes the packet to the operation waiting for it,
+// it returns false when nobody is waiting for the packet id.
+//
+// Acknowledged packets are not retransmitted anymore,
+// the next step of the flow is tracked by its initiator.
+func (f *inflight) deliver(id uint16, pk packet.IncomingPacket) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fl, ok := f.m[id]
+	if !ok {
+		return false
+	}
+	select {
+	case fl.ackc <- pk:
+		fl.pk = nil
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInflightAlloc(t *testing.T) {
+	f := newInflight()
+	if _, err := f.add(3); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint16]bool, maxPacketIDs)
+	seen[3] = true
+	for i := 1; i < maxPacketIDs; i++ {
+		id, _, err := f.alloc(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 0 || seen[id] {
+			t.Fatalf("alloc returned invalid or duplicate id %d", id)
+		}
+		seen[id] = true
+	}
+
+	if _, err := f.add(100); err != errPacketIDInUse {
+		t.Fatalf("add(100) = %v, want %v", err, errPacketIDInUse)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := f.alloc(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("alloc on exhausted ids = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	idc := make(chan uint16)
+	go func() {
+		id, _, err := f.alloc(context.Background(), nil)
+		if err != nil {
+			t.Error(err)
+		}
+		idc <- id
+	}()
+	time.Sleep(10 * time.Millisecond)
+	f.delete(100)
+	select {
+	case id := <-idc:
+		if id != 100 {
+			t.Fatalf("alloc after release = %d, want 100", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("alloc is not unblocked after release")
+	}
+}
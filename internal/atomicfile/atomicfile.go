@@ -0,0 +1,32 @@
+// Package atomicfile replaces files in a single step,
+// it's shared by the client and broker file stores.
+package atomicfile
+
+import "os"
+
+// TmpSuffix is the suffix of files being written.
+const TmpSuffix = ".tmp"
+
+// Write writes the file under a temporary name and then renames
+// it to replace the previous version in a single step, so readers never
+// see partially written files even when the process crashes.
+func Write(name string, b []byte) error {
+	f, err := os.OpenFile(name+TmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+TmpSuffix, name)
+	}
+	if err != nil {
+		os.Remove(name + TmpSuffix)
+		return err
+	}
+	return nil
+}
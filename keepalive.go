@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPingTimeout is returned when the server doesn't respond
+// to a keep-alive ping in time and the connection is closed.
+var ErrPingTimeout = errors.New("ping response timeout")
+
+// keepAlive sends PINGREQ every time the connection has been idle
+// for the keep-alive interval until the connection is closed.
+func (c *Client) keepAlive(cn *conn, interval time.Duration) {
+	timeout := c.pingTimeout
+	if timeout == 0 {
+		timeout = interval
+	}
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-cn.done:
+			return
+		}
+		if idle := cn.idle(); idle < interval {
+			t.Reset(interval - idle)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := c.ping(ctx, cn)
+		cancel()
+		switch err {
+		case nil:
+			t.Reset(interval)
+		case context.DeadlineExceeded:
+			c.lost(cn, ErrPingTimeout)
+			return
+		default:
+			return
+		}
+	}
+}
@@ -1,27 +1,123 @@
 package mqtt
 
-func Match(route, topic string) bool {
-	var j int
-	for i := 0; i < len(topic); i++ {
-		switch route[j] {
-		case '#':
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Match reports whether the topic name matches the topic filter
+// according to MQTT 3.1.1 §4.7, invalid filters and topic names match nothing.
+//
+// '+' matches exactly one topic level including empty ones, '#' matches the
+// parent level and any number of child levels, filters starting with
+// a wildcard don't match topic names starting with '$'.
+func Match(filter, topic string) bool {
+	if ValidateTopicFilter(filter) != nil || ValidateTopicName(topic) != nil {
+		return false
+	}
+	if topic[0] == '$' && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	for {
+		// levels are compared one by one without allocations
+		fl, fnext := nextLevel(filter)
+		tl, tnext := nextLevel(topic)
+		switch {
+		case fl == "#":
 			return true
-		case '+':
-			if topic[i] != '/' {
-				continue
-			}
-			j++
-		default:
-			if route[j] != topic[i] {
-				return false
-			}
+		case fl != "+" && fl != tl:
+			return false
 		}
-		re := len(route) <= j+1
-		te := len(topic) == i+1
-		if !te && re || te && !re {
+		switch {
+		case !fnext && !tnext:
+			return true
+		case !tnext:
+			// "a/#" matches "a"
+			return filter[len(fl)+1:] == "#"
+		case !fnext:
 			return false
 		}
-		j++
+		filter, topic = filter[len(fl)+1:], topic[len(tl)+1:]
+	}
+}
+
+// nextLevel returns the first topic level and reports whether it's followed by more.
+func nextLevel(s string) (string, bool) {
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		return s[:i], true
+	}
+	return s, false
+}
+
+const maxTopicLen = 65535
+
+// ValidateTopicName checks that the topic name can be used for publishing,
+// it has to be a non-empty UTF-8 string without wildcards and null characters.
+func ValidateTopicName(topic string) error {
+	if err := validateTopic(topic); err != nil {
+		return fmt.Errorf("invalid topic name %q: %s", topic, err)
+	}
+	if i := strings.IndexAny(topic, "+#"); i != -1 {
+		return fmt.Errorf("invalid topic name %q: wildcard %q is not allowed", topic, topic[i])
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks that the topic filter can be subscribed to,
+// wildcards have to occupy entire topic levels and '#' has to be the last one.
+//
+// MQTT 5.0 shared subscriptions "$share/{group}/{filter}" are supported too.
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopicFilter(filter); err != nil {
+		return fmt.Errorf("invalid topic filter %q: %s", filter, err)
+	}
+	return nil
+}
+
+func validateTopicFilter(filter string) error {
+	if err := validateTopic(filter); err != nil {
+		return err
+	}
+	if strings.HasPrefix(filter, "$share/") {
+		group, next := nextLevel(filter[len("$share/"):])
+		switch {
+		case group == "":
+			return errors.New("shared subscription group is empty")
+		case strings.ContainsAny(group, "+#"):
+			return errors.New("shared subscription group contains wildcards")
+		case !next || len(filter) == len("$share/")+len(group)+1:
+			return errors.New("shared subscription filter is empty")
+		}
+		filter = filter[len("$share/")+len(group)+1:]
+	}
+	for {
+		level, next := nextLevel(filter)
+		switch {
+		case level == "#" && next:
+			return errors.New("'#' must be the last level")
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return fmt.Errorf("wildcard in level %q must occupy the entire level", level)
+		}
+		if !next {
+			return nil
+		}
+		filter = filter[len(level)+1:]
+	}
+}
+
+func validateTopic(s string) error {
+	switch {
+	case s == "":
+		return errors.New("empty")
+	case len(s) > maxTopicLen:
+		return fmt.Errorf("longer than %d bytes", maxTopicLen)
+	case !utf8.ValidString(s):
+		return errors.New("malformed UTF-8")
+	case strings.IndexByte(s, 0) != -1:
+		return errors.New("null character is not allowed")
 	}
-	return true
+	return nil
 }
@@ -1,6 +1,9 @@
 package mqtt
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestMatch(t *testing.T) {
 	for _, run := range []struct {
@@ -18,11 +21,80 @@ func TestMatch(t *testing.T) {
 		{"/+/+", "/a/b", true},
 		{"/a/+/b", "/a/z/b", true},
 		{"/a/b/+", "/a/b/cc", true},
-		{"/a/b+", "/a/ba", true},
+		{"/a/b+", "/a/ba", false},
 		{"/a/b+", "/a/aa", false},
+		{"#", "a/b/c", true},
+		{"#", "/", true},
+		{"a/#", "a", true},
+		{"a/#", "a/", true},
+		{"a/#", "ab", false},
+		{"a/b/#", "a", false},
+		{"+", "a", true},
+		{"+", "/a", false},
+		{"+/+", "/a", true},
+		{"+/+", "/", true},
+		{"a/+", "a", false},
+		{"a/+", "a/", true},
+		{"+/#", "a", true},
+		{"a", "a/b/c/d/e/f", false},
+		{"a/b/c/d", "a", false},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"$SYS/+", "$SYS/a", true},
+		{"a/#/b", "a/x/b", false},
+		{"a/#", "a/+", false},
+		{"", "a", false},
+		{"a", "", false},
 	} {
 		if have := Match(run.template, run.topic); have != run.want {
 			t.Errorf("Match(%q, %q) = %t, want %t", run.template, run.topic, have, run.want)
 		}
 	}
 }
+
+func TestValidateTopicName(t *testing.T) {
+	for topic, valid := range map[string]bool{
+		"a":                        true,
+		"/":                        true,
+		"a//b":                     true,
+		"$SYS/a":                   true,
+		"":                         false,
+		"a/+":                      false,
+		"a/#":                      false,
+		"a\x00b":                   false,
+		"\xff":                     false,
+		strings.Repeat("a", 65536): false,
+	} {
+		if err := ValidateTopicName(topic); (err == nil) != valid {
+			t.Errorf("ValidateTopicName(%.10q) = %v, want valid = %t", topic, err, valid)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for filter, valid := range map[string]bool{
+		"a":             true,
+		"#":             true,
+		"+":             true,
+		"+/+/#":         true,
+		"/+/":           true,
+		"$share/g/a/+":  true,
+		"$share/g/#":    true,
+		"":              false,
+		"a/#/b":         false,
+		"a#":            false,
+		"a/b+":          false,
+		"a/+b/c":        false,
+		"a\x00":         false,
+		"$share/g":      false,
+		"$share/g/":     false,
+		"$share//a":     false,
+		"$share/+/a":    false,
+		"$share/g/a/b#": false,
+	} {
+		if err := ValidateTopicFilter(filter); (err == nil) != valid {
+			t.Errorf("ValidateTopicFilter(%q) = %v, want valid = %t", filter, err, valid)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// NewServeMux creates an empty messages router.
+func NewServeMux() *ServeMux {
+	return &ServeMux{root: newMuxNode()}
+}
+
+// ServeMux routes incoming messages to handlers registered
+// for topic filters that match their topic names.
+//
+// Filters are kept in a trie of topic levels, so dispatching takes time
+// proportional to the number of topic levels rather than filters.
+//
+// When several filters match a message, handlers of all of them are
+// called one after another in the order the filters have been registered,
+// so a handler registered for multiple matching filters is called
+// once for each of them, the same way servers deliver messages
+// to clients with overlapping subscriptions.
+type ServeMux struct {
+	mu   sync.RWMutex
+	root *muxNode
+	seq  uint64
+}
+
+type muxNode struct {
+	children map[string]*muxNode // including + and #
+	entry    *muxEntry
+}
+
+type muxEntry struct {
+	seq     uint64
+	handler MessagesHandler
+}
+
+func newMuxNode() *muxNode {
+	return &muxNode{children: make(map[string]*muxNode)}
+}
+
+// Handle registers the handler for the given topic filter
+// replacing the previous one, the replaced filter keeps its position.
+func (m *ServeMux) Handle(filter string, handler MessagesHandler) {
+	m.handle(filter, handler, true)
+}
+
+// handle registers the handler and returns the previous one,
+// it's replaced only when replace is true.
+func (m *ServeMux) handle(filter string, handler MessagesHandler, replace bool) MessagesHandler {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			child = newMuxNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	if n.entry != nil {
+		prev := n.entry.handler
+		if replace {
+			n.entry.handler = handler
+		}
+		return prev
+	}
+	m.seq++
+	n.entry = &muxEntry{seq: m.seq, handler: handler}
+	return nil
+}
+
+// Remove unregisters the handler of the given topic filter.
+func (m *ServeMux) Remove(filter string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.root.remove(strings.Split(filter, "/"))
+}
+
+// remove removes the entry of the given levels
+// and reports whether the node is empty afterwards.
+func (n *muxNode) remove(levels []string) bool {
+	if len(levels) == 0 {
+		n.entry = nil
+	} else if child, ok := n.children[levels[0]]; ok && child.remove(levels[1:]) {
+		delete(n.children, levels[0])
+	}
+	return n.entry == nil && len(n.children) == 0
+}
+
+// Handlers returns handlers matching the given topic name in the dispatching order.
+func (m *ServeMux) Handlers(topic string) []MessagesHandler {
+	levels := strings.Split(topic, "/")
+	m.mu.RLock()
+	var entries []*muxEntry
+	m.root.match(levels, strings.HasPrefix(topic, "$"), &entries)
+	m.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	handlers := make([]MessagesHandler, 0, len(entries))
+	for _, e := range entries {
+		handlers = append(handlers, e.handler)
+	}
+	return handlers
+}
+
+// match collects entries matching the given topic levels,
+// wildcards on the first level don't match topics starting with $.
+func (n *muxNode) match(levels []string, sys bool, entries *[]*muxEntry) {
+	if child, ok := n.children["#"]; ok && child.entry != nil && !sys {
+		*entries = append(*entries, child.entry) // it matches the parent level too
+	}
+	if len(levels) == 0 {
+		if n.entry != nil {
+			*entries = append(*entries, n.entry)
+		}
+		return
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, entries)
+	}
+	if child, ok := n.children["+"]; ok && !sys {
+		child.match(levels[1:], false, entries)
+	}
+}
+
+// Dispatch passes the message to all matching handlers and reports
+// whether there were any, it can be used as a MessagesHandler.
+func (m *ServeMux) Dispatch(publish *packet.Publish) bool {
+	handlers := m.Handlers(publish.Topic)
+	for _, h := range handlers {
+		h(publish)
+	}
+	return len(handlers) != 0
+}
+
+// WithServeMux sets the router the client dispatches incoming messages with,
+// messages that match no filters are passed to the messages handler.
+func WithServeMux(mux *ServeMux) Option {
+	return func(c *Client) {
+		c.mux = mux
+	}
+}
+
+// SubscribeHandler subscribes to the topic filters and registers the handler
+// for each of them in the client's router, handlers are removed when
+// they're unsubscribed, and when subscribing fails or the server rejects
+// subscriptions handlers registered for the filters before are restored.
+//
+// Shared subscriptions are registered without the $share/{group}/ prefix,
+// because messages delivered to them have original topic names.
+func (c *Client) SubscribeHandler(
+	ctx context.Context, handler MessagesHandler, opts ...packet.SubscribeOption,
+) (*packet.Suback, error) {
+	// handlers are registered beforehand, because retained
+	// messages may be received right after SUBACK
+	topics := packet.NewSubscribe(opts...).Topics
+	prev := make([]MessagesHandler, len(topics))
+	for i, topic := range topics {
+		prev[i] = c.mux.handle(muxFilter(topic.Name), handler, true)
+	}
+	suback, err := c.Subscribe(ctx, opts...)
+	// going backwards restores the right handler when filters repeat
+	for i := len(topics) - 1; i >= 0; i-- {
+		if err != nil || i >= len(suback.ReturnCodes) ||
+			suback.ReturnCodes[i] >= packet.SubscriptionFailure {
+			c.restoreHandler(muxFilter(topics[i].Name), prev[i])
+		}
+	}
+	return suback, err
+}
+
+// restoreHandler registers the previous handler of the filter again
+// or removes the filter when there was none.
+func (c *Client) restoreHandler(filter string, prev MessagesHandler) {
+	if prev != nil {
+		c.mux.Handle(filter, prev)
+	} else {
+		c.mux.Remove(filter)
+	}
+}
+
+// muxFilter strips the shared subscription prefix.
+func muxFilter(filter string) string {
+	if strings.HasPrefix(filter, "$share/") {
+		if i := strings.IndexByte(filter[len("$share/"):], '/'); i != -1 {
+			return filter[len("$share/")+i+1:]
+		}
+	}
+	return filter
+}
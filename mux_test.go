@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestServeMux(t *testing.T) {
+	var have []string
+	m := NewServeMux()
+	for _, filter := range []string{
+		"a/#", "a/b", "+/b", "#", "a/+/c", "$SYS/#", "+/+", "a/b/#",
+	} {
+		filter := filter
+		m.Handle(filter, func(*packet.Publish) {
+			have = append(have, filter)
+		})
+	}
+
+	for topic, want := range map[string][]string{
+		"a":        {"a/#", "#"},
+		"a/b":      {"a/#", "a/b", "+/b", "#", "+/+", "a/b/#"},
+		"a/x/c":    {"a/#", "#", "a/+/c"},
+		"x/b":      {"+/b", "#", "+/+"},
+		"$SYS/x":   {"$SYS/#"},
+		"$SYS":     {"$SYS/#"},
+		"/b":       {"+/b", "#", "+/+"},
+		"a/b/c/d":  {"a/#", "#", "a/b/#"},
+		"b/b/b/b/": {"#"},
+	} {
+		have = nil
+		if ok := m.Dispatch(packet.NewPublish(topic)); !ok {
+			t.Errorf("%q: no handlers", topic)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%q: dispatched to %v, want %v", topic, have, want)
+		}
+	}
+
+	// replaced handlers keep their order
+	m.Handle("a/b", func(*packet.Publish) {
+		have = append(have, "replaced")
+	})
+	m.Remove("#")
+	m.Remove("+/+")
+	m.Remove("x/y/z") // not registered
+	have = nil
+	m.Dispatch(packet.NewPublish("a/b"))
+	if want := []string{"a/#", "replaced", "+/b", "a/b/#"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("dispatched to %v, want %v", have, want)
+	}
+	if m.Dispatch(packet.NewPublish("b")) {
+		t.Error("dispatched unmatched message")
+	}
+}
+
+func TestSubscribeHandler(t *testing.T) {
+	var handled, unhandled []string
+	c, s := newPipeClient(t, WithMessagesHandler(func(publish *packet.Publish) {
+		unhandled = append(unhandled, publish.Topic)
+	}))
+	defer c.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.SubscribeHandler(context.Background(), func(publish *packet.Publish) {
+			handled = append(handled, publish.Topic)
+		},
+			packet.WithSubscribeTopic("$share/g/a/+", packet.QoS0),
+			packet.WithSubscribeTopic("b", packet.QoS0),
+		)
+		errc <- err
+	}()
+	subscribe, ok := s.recv().(*packet.Subscribe)
+	if !ok {
+		t.Fatal("subscribe expected")
+	}
+	s.send(packet.NewSuback(subscribe.PacketID, packet.WithSubackReturnCodes(
+		packet.SubscriptionMaxQoS0, packet.SubscriptionFailure,
+	)))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	s.send(packet.NewPublish("a/1"))
+	s.send(packet.NewPublish("b"))
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/1"}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled = %v, want %v", handled, want)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(unhandled, want) {
+		t.Errorf("unhandled = %v, want %v", unhandled, want)
+	}
+}
+
+func TestSubscribeHandlerRestore(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	var handled []string
+	subscribeHandler := func(name string, rc uint8) {
+		t.Helper()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := c.SubscribeHandler(context.Background(), func(publish *packet.Publish) {
+				handled = append(handled, name)
+			}, packet.WithSubscribeTopic("a", packet.QoS0))
+			errc <- err
+		}()
+		subscribe, ok := s.recv().(*packet.Subscribe)
+		if !ok {
+			t.Fatal("subscribe expected")
+		}
+		s.send(packet.NewSuback(subscribe.PacketID, packet.WithSubackReturnCodes(rc)))
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribeHandler("first", packet.SubscriptionMaxQoS0)
+	subscribeHandler("second", packet.SubscriptionFailure)
+
+	s.send(packet.NewPublish("a"))
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"first"}; !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled = %v, want %v", handled, want)
+	}
+}
+
+// ping makes sure that all packets sent to the client before are processed.
+func ping(c *Client, s *fakeServer) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Ping(context.Background())
+	}()
+	s.expect(packet.NewPingreq())
+	s.send(packet.NewPingresp())
+	return <-errc
+}
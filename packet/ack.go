@@ -0,0 +1,106 @@
+package packet
+
+import (
+	"fmt"
+)
+
+// encodeAck encodes PUBACK, PUBREC, PUBREL and PUBCOMP packets
+// that share the same structure, MQTT 5.0 reason code and
+// properties are omitted when it's possible.
+func encodeAck(e Encoder, id uint16, rc ReasonCode, props *Properties) error {
+	n := integerLen // PacketID
+	v5 := isV5(e.ProtocolLevel())
+	hasProps := v5 && !props.empty()
+	hasReason := v5 && (rc != Success || hasProps)
+	if hasReason {
+		n += bitsLen
+	}
+	if hasProps {
+		n += props.len()
+	}
+
+	var err error
+	if err = e.Len(n); err != nil {
+		return err
+	}
+	if err = e.Integer(id); err != nil {
+		return err
+	}
+	if hasReason {
+		if err = e.Bits(uint8(rc)); err != nil {
+			return err
+		}
+	}
+	if hasProps {
+		return props.encode(e)
+	}
+	return nil
+}
+
+func decodeAck(d Decoder, id *uint16, rc *ReasonCode, props *Properties) error {
+	var err error
+	*id, err = d.Integer()
+	if err != nil {
+		return err
+	}
+	if !isV5(d.ProtocolLevel()) || d.Len() == 0 {
+		return nil
+	}
+	c, err := d.Bits()
+	if err != nil {
+		return err
+	}
+	*rc = ReasonCode(c)
+	if d.Len() == 0 {
+		return nil
+	}
+	return props.decode(d)
+}
+
+func ackString(name string, id uint16, rc ReasonCode) string {
+	if rc != Success {
+		return fmt.Sprintf("%s (m%d, c%d)", name, id, rc)
+	}
+	return fmt.Sprintf("%s (m%d)", name, id)
+}
+
+// encodeReason encodes DISCONNECT and AUTH packets that consist
+// of an optional reason code followed by optional properties.
+func encodeReason(e Encoder, rc ReasonCode, props *Properties) error {
+	v5 := isV5(e.ProtocolLevel())
+	hasProps := v5 && !props.empty()
+	if !hasProps && (!v5 || rc == Success) {
+		return e.Len(0)
+	}
+
+	n := bitsLen
+	if hasProps {
+		n += props.len()
+	}
+	var err error
+	if err = e.Len(n); err != nil {
+		return err
+	}
+	if err = e.Bits(uint8(rc)); err != nil {
+		return err
+	}
+	if hasProps {
+		return props.encode(e)
+	}
+	return nil
+}
+
+func decodeReason(d Decoder, rc *ReasonCode, props *Properties) error {
+	if !isV5(d.ProtocolLevel()) || d.Len() == 0 {
+		return nil
+	}
+	c, err := d.Bits()
+	if err != nil {
+		return err
+	}
+	*rc = ReasonCode(c)
+	if d.Len() == 0 {
+		return nil
+	}
+	return props.decode(d)
+}
@@ -0,0 +1,48 @@
+package packet
+
+import (
+	"fmt"
+)
+
+type AuthOption func(pk *Auth)
+
+func WithAuthReasonCode(rc ReasonCode) AuthOption {
+	return func(pk *Auth) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithAuthProperties(props Properties) AuthOption {
+	return func(pk *Auth) {
+		pk.Properties = props
+	}
+}
+
+// NewAuth creates an MQTT 5.0 AUTH packet used for enhanced authentication.
+func NewAuth(opts ...AuthOption) *Auth {
+	pk := &Auth{
+		Flags: pkAuth,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
+
+type Auth struct {
+	Flags
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (pk *Auth) Encode(e Encoder) error {
+	return encodeReason(e, pk.ReasonCode, &pk.Properties)
+}
+
+func (pk *Auth) Decode(d Decoder) error {
+	return decodeReason(d, &pk.ReasonCode, &pk.Properties)
+}
+
+func (pk *Auth) String() string {
+	return fmt.Sprintf("AUTH (c%d, %q)", pk.ReasonCode, pk.Properties.AuthenticationMethod)
+}
@@ -54,6 +54,18 @@ func WithConnackReturnCode(rc ConnectReturnCode) ConnackOption {
 	}
 }
 
+func WithConnackReasonCode(rc ReasonCode) ConnackOption {
+	return func(pk *Connack) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithConnackProperties(props Properties) ConnackOption {
+	return func(pk *Connack) {
+		pk.Properties = props
+	}
+}
+
 func NewConnack(opts ...ConnackOption) *Connack {
 	pk := &Connack{
 		Flags: pkConnack,
@@ -71,6 +83,35 @@ type Connack struct {
 	AcknowledgeFlags uint8
 
 	ReturnCode ConnectReturnCode
+
+	// ReasonCode and Properties are MQTT 5.0 only, when decoding
+	// ReturnCode is populated with the closest matching value as well.
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (pk *Connack) Encode(e Encoder) error {
+	v5 := isV5(e.ProtocolLevel())
+	n := bitsLen + // AcknowledgeFlags
+		bitsLen // ReturnCode
+	if v5 {
+		n += pk.Properties.len()
+	}
+
+	var err error
+	if err = e.Len(n); err != nil {
+		return err
+	}
+	if err = e.Bits(pk.AcknowledgeFlags); err != nil {
+		return err
+	}
+	if !v5 {
+		return e.Bits(uint8(pk.ReturnCode))
+	}
+	if err = e.Bits(uint8(pk.ReasonCode)); err != nil {
+		return err
+	}
+	return pk.Properties.encode(e)
 }
 
 func (pk *Connack) Decode(d Decoder) error {
@@ -83,8 +124,32 @@ func (pk *Connack) Decode(d Decoder) error {
 	if err != nil {
 		return err
 	}
-	pk.ReturnCode = ConnectReturnCode(rc)
-	return nil
+
+	// servers that don't support MQTT 5.0 respond with 3.1.1 packets
+	if !isV5(d.ProtocolLevel()) || d.Len() == 0 {
+		pk.ReturnCode = ConnectReturnCode(rc)
+		return nil
+	}
+	pk.ReasonCode = ReasonCode(rc)
+	pk.ReturnCode = returnCodeFromReasonCode(pk.ReasonCode)
+	return pk.Properties.decode(d)
+}
+
+func returnCodeFromReasonCode(rc ReasonCode) ConnectReturnCode {
+	switch rc {
+	case Success:
+		return ConnectionAccepted
+	case UnsupportedProtocolVersion:
+		return ConnectionUnacceptableProtocolVersion
+	case ClientIdentifierNotValid:
+		return ConnectionIdentifierRejected
+	case BadUserNameOrPassword:
+		return ConnectionBadUsernameOrPassword
+	case NotAuthorized, Banned, BadAuthenticationMethod:
+		return ConnectionNotAuthorized
+	default:
+		return ConnectionServerUnavailable
+	}
 }
 
 func (pk Connack) String() string {
@@ -6,7 +6,10 @@ import (
 
 var ProtocolName = "MQTT"
 
-const ProtocolLevel311 = 0x04
+const (
+	ProtocolLevel311 = 0x04
+	ProtocolLevel5   = 0x05
+)
 
 const (
 	ConnectFlagCleanSession = 2 << iota
@@ -90,6 +93,18 @@ func WithConnectPassword(password string) ConnectOption {
 	}
 }
 
+func WithConnectProperties(props Properties) ConnectOption {
+	return func(pk *Connect) {
+		pk.Properties = props
+	}
+}
+
+func WithConnectWillProperties(props Properties) ConnectOption {
+	return func(pk *Connect) {
+		pk.WillProperties = props
+	}
+}
+
 func NewConnect(opts ...ConnectOption) *Connect {
 	pk := &Connect{
 		Flags:         pkConnect,
@@ -113,12 +128,17 @@ type Connect struct {
 	WillPayload   []byte
 	Username      string
 	Password      string
+
+	// MQTT 5.0 only.
+	Properties     Properties
+	WillProperties Properties
 }
 
 func (pk *Connect) Encode(e Encoder) error {
 	hasWill := enabled(pk.ConnectFlags, ConnectFlagWillFlag)
 	hasUsername := enabled(pk.ConnectFlags, ConnectFlagUsername)
 	hasPassword := enabled(pk.ConnectFlags, ConnectFlagPassword)
+	v5 := isV5(pk.ProtocolLevel)
 
 	n := stringLen(pk.ProtocolName) +
 		bitsLen + // ProtocolLevel
@@ -126,8 +146,14 @@ func (pk *Connect) Encode(e Encoder) error {
 		integerLen + // KeepAlive
 		stringLen(pk.ClientID)
 
+	if v5 {
+		n += pk.Properties.len()
+	}
 	if hasWill {
 		n += stringLen(pk.WillTopic) + bytesLen(pk.WillPayload)
+		if v5 {
+			n += pk.WillProperties.len()
+		}
 	}
 	if hasUsername {
 		n += stringLen(pk.Username)
@@ -152,10 +178,20 @@ func (pk *Connect) Encode(e Encoder) error {
 	if err = e.Integer(pk.KeepAlive); err != nil {
 		return err
 	}
+	if v5 {
+		if err = pk.Properties.encode(e); err != nil {
+			return err
+		}
+	}
 	if err = e.String(pk.ClientID); err != nil {
 		return err
 	}
 	if hasWill {
+		if v5 {
+			if err = pk.WillProperties.encode(e); err != nil {
+				return err
+			}
+		}
 		if err = e.String(pk.WillTopic); err != nil {
 			return err
 		}
@@ -176,6 +212,55 @@ func (pk *Connect) Encode(e Encoder) error {
 	return nil
 }
 
+func (pk *Connect) Decode(d Decoder) error {
+	var err error
+	if pk.ProtocolName, err = d.String(); err != nil {
+		return err
+	}
+	if pk.ProtocolLevel, err = d.Bits(); err != nil {
+		return err
+	}
+	if pk.ConnectFlags, err = d.Bits(); err != nil {
+		return err
+	}
+	if pk.KeepAlive, err = d.Integer(); err != nil {
+		return err
+	}
+	v5 := isV5(pk.ProtocolLevel)
+	if v5 {
+		if err = pk.Properties.decode(d); err != nil {
+			return err
+		}
+	}
+	if pk.ClientID, err = d.String(); err != nil {
+		return err
+	}
+	if enabled(pk.ConnectFlags, ConnectFlagWillFlag) {
+		if v5 {
+			if err = pk.WillProperties.decode(d); err != nil {
+				return err
+			}
+		}
+		if pk.WillTopic, err = d.String(); err != nil {
+			return err
+		}
+		if pk.WillPayload, err = d.Bytes(); err != nil {
+			return err
+		}
+	}
+	if enabled(pk.ConnectFlags, ConnectFlagUsername) {
+		if pk.Username, err = d.String(); err != nil {
+			return err
+		}
+	}
+	if enabled(pk.ConnectFlags, ConnectFlagPassword) {
+		if pk.Password, err = d.String(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pk *Connect) String() string {
 	// TODO: add will props
 	return fmt.Sprintf("CONNECT (p%d, c%d, k%d, i%q)",
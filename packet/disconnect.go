@@ -1,19 +1,52 @@
 package packet
 
-func NewDisconnect() *Disconnect {
-	return &Disconnect{
+import (
+	"fmt"
+)
+
+type DisconnectOption func(pk *Disconnect)
+
+func WithDisconnectReasonCode(rc ReasonCode) DisconnectOption {
+	return func(pk *Disconnect) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithDisconnectProperties(props Properties) DisconnectOption {
+	return func(pk *Disconnect) {
+		pk.Properties = props
+	}
+}
+
+func NewDisconnect(opts ...DisconnectOption) *Disconnect {
+	pk := &Disconnect{
 		Flags: pkDisconnect,
 	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
 }
 
 type Disconnect struct {
 	Flags
+
+	// MQTT 5.0 only.
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func (pk *Disconnect) Encode(e Encoder) error {
-	return e.Len(0)
+	return encodeReason(e, pk.ReasonCode, &pk.Properties)
+}
+
+func (pk *Disconnect) Decode(d Decoder) error {
+	return decodeReason(d, &pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Disconnect) String() string {
+	if pk.ReasonCode != NormalDisconnection {
+		return fmt.Sprintf("DISCONNECT (c%d)", pk.ReasonCode)
+	}
 	return "DISCONNECT"
 }
@@ -33,25 +33,42 @@ const (
 	pkPingreq
 	pkPingresp
 	pkDisconnect
+	pkAuth
 )
 
 type Encoder interface {
 	Len(int) error
 	Bits(uint8) error
 	Integer(uint16) error
+	Integer32(uint32) error
+	VarInt(uint32) error
 	Payload([]byte) error
 	Bytes([]byte) error
 	String(string) error
+
+	// ProtocolLevel is the protocol version packets are encoded with.
+	ProtocolLevel() uint8
 }
 
 type Decoder interface {
 	Bits() (uint8, error)
 	Integer() (uint16, error)
+	Integer32() (uint32, error)
+	VarInt() (uint32, error)
 	Payload() ([]byte, error)
 	Bytes() ([]byte, error)
 	String() (string, error)
+
+	// Len is the number of bytes remaining unread in the current packet.
+	Len() int
+
+	// ProtocolLevel is the protocol version packets are decoded with.
+	ProtocolLevel() uint8
 }
 
+// NewIncomingPacket creates an empty client-bound packet
+// of the type specified in the fixed header or nil if it's
+// not allowed to be sent by servers.
 func NewIncomingPacket(fh uint8) IncomingPacket {
 	switch fh & 0xf0 {
 	case pkConnack:
@@ -62,6 +79,8 @@ func NewIncomingPacket(fh uint8) IncomingPacket {
 		return &Puback{Flags: Flags(fh)}
 	case pkPubrec:
 		return &Pubrec{Flags: Flags(fh)}
+	case pkPubrel:
+		return &Pubrel{Flags: Flags(fh)}
 	case pkPubcomp:
 		return &Pubcomp{Flags: Flags(fh)}
 	case pkSuback:
@@ -70,11 +89,55 @@ func NewIncomingPacket(fh uint8) IncomingPacket {
 		return &Unsuback{Flags: Flags(fh)}
 	case pkPingresp:
 		return &Pingresp{Flags: Flags(fh)}
+	case pkDisconnect:
+		return &Disconnect{Flags: Flags(fh)}
+	case pkAuth:
+		return &Auth{Flags: Flags(fh)}
 	default:
 		return nil
 	}
 }
 
+// NewServerBoundPacket creates an empty server-bound packet
+// of the type specified in the fixed header or nil if it's
+// not allowed to be sent by clients.
+func NewServerBoundPacket(fh uint8) Packet {
+	switch fh & 0xf0 {
+	case pkConnect:
+		return &Connect{Flags: Flags(fh)}
+	case pkPublish:
+		return &Publish{Flags: Flags(fh)}
+	case pkPuback:
+		return &Puback{Flags: Flags(fh)}
+	case pkPubrec:
+		return &Pubrec{Flags: Flags(fh)}
+	case pkPubrel:
+		return &Pubrel{Flags: Flags(fh)}
+	case pkPubcomp:
+		return &Pubcomp{Flags: Flags(fh)}
+	case pkSubscribe:
+		return &Subscribe{Flags: Flags(fh)}
+	case pkUnsubscribe:
+		return &Unsubscribe{Flags: Flags(fh)}
+	case pkPingreq:
+		return &Pingreq{Flags: Flags(fh)}
+	case pkDisconnect:
+		return &Disconnect{Flags: Flags(fh)}
+	case pkAuth:
+		return &Auth{Flags: Flags(fh)}
+	default:
+		return nil
+	}
+}
+
+// Packet is implemented by all packet types,
+// that can be both encoded and decoded.
+type Packet interface {
+	packet
+	Encode(e Encoder) error
+	Decode(d Decoder) error
+}
+
 type OutgoingPacket interface {
 	packet
 	Encode(e Encoder) error
@@ -101,11 +164,29 @@ func enabled(flags, flag uint8) bool {
 	return flags&flag != 0
 }
 
+func isV5(level uint8) bool {
+	return level == ProtocolLevel5
+}
+
 const (
-	bitsLen    = 1
-	integerLen = 2
+	bitsLen      = 1
+	integerLen   = 2
+	integer32Len = 4
 )
 
+func varIntLen(n int) int {
+	switch {
+	case n < 128:
+		return 1
+	case n < 128*128:
+		return 2
+	case n < 128*128*128:
+		return 3
+	default:
+		return 4
+	}
+}
+
 func stringLen(s string) int {
 	return integerLen + len(s)
 }
@@ -14,6 +14,10 @@ func (pk *Pingreq) Encode(e Encoder) error {
 	return e.Len(0)
 }
 
+func (pk *Pingreq) Decode(d Decoder) error {
+	return nil
+}
+
 func (pk *Pingreq) String() string {
 	return "PINGREQ"
 }
@@ -1,9 +1,19 @@
 package packet
 
+func NewPingresp() *Pingresp {
+	return &Pingresp{
+		Flags: pkPingresp,
+	}
+}
+
 type Pingresp struct {
 	Flags
 }
 
+func (pk *Pingresp) Encode(e Encoder) error {
+	return e.Len(0)
+}
+
 func (pk *Pingresp) Decode(d Decoder) error {
 	return nil
 }
@@ -0,0 +1,349 @@
+package packet
+
+import (
+	"fmt"
+)
+
+// PropertyID identifies an MQTT 5.0 property.
+type PropertyID uint8
+
+const (
+	PropPayloadFormatIndicator          PropertyID = 0x01
+	PropMessageExpiryInterval           PropertyID = 0x02
+	PropContentType                     PropertyID = 0x03
+	PropResponseTopic                   PropertyID = 0x08
+	PropCorrelationData                 PropertyID = 0x09
+	PropSubscriptionIdentifier          PropertyID = 0x0b
+	PropSessionExpiryInterval           PropertyID = 0x11
+	PropAssignedClientIdentifier        PropertyID = 0x12
+	PropServerKeepAlive                 PropertyID = 0x13
+	PropAuthenticationMethod            PropertyID = 0x15
+	PropAuthenticationData              PropertyID = 0x16
+	PropRequestProblemInformation       PropertyID = 0x17
+	PropWillDelayInterval               PropertyID = 0x18
+	PropRequestResponseInformation      PropertyID = 0x19
+	PropResponseInformation             PropertyID = 0x1a
+	PropServerReference                 PropertyID = 0x1c
+	PropReasonString                    PropertyID = 0x1f
+	PropReceiveMaximum                  PropertyID = 0x21
+	PropTopicAliasMaximum               PropertyID = 0x22
+	PropTopicAlias                      PropertyID = 0x23
+	PropMaximumQoS                      PropertyID = 0x24
+	PropRetainAvailable                 PropertyID = 0x25
+	PropUserProperty                    PropertyID = 0x26
+	PropMaximumPacketSize               PropertyID = 0x27
+	PropWildcardSubscriptionAvailable   PropertyID = 0x28
+	PropSubscriptionIdentifierAvailable PropertyID = 0x29
+	PropSharedSubscriptionAvailable     PropertyID = 0x2a
+)
+
+// UserProperty is a name-value pair, the same name is allowed to appear more than once.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties is the MQTT 5.0 property set, nil and empty values are not encoded.
+//
+// Every packet type accepts only a subset of the properties,
+// it's up to the caller not to set the ones that are not allowed.
+type Properties struct {
+	PayloadFormatIndicator          *uint8
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []uint32
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *uint8
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *uint8
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *uint8
+	RetainAvailable                 *uint8
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *uint8
+	SubscriptionIdentifierAvailable *uint8
+	SharedSubscriptionAvailable     *uint8
+}
+
+// Uint8 returns a pointer to v, it's handy for setting optional properties.
+func Uint8(v uint8) *uint8 {
+	return &v
+}
+
+// Uint16 returns a pointer to v.
+func Uint16(v uint16) *uint16 {
+	return &v
+}
+
+// Uint32 returns a pointer to v.
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+// varInt is a value encoded as a variable byte integer.
+type varInt uint32
+
+// each calls fn for every property that is set in the wire order.
+func (p *Properties) each(fn func(id PropertyID, v interface{}) error) error {
+	var err error
+	u8 := func(id PropertyID, v *uint8) {
+		if err == nil && v != nil {
+			err = fn(id, *v)
+		}
+	}
+	u16 := func(id PropertyID, v *uint16) {
+		if err == nil && v != nil {
+			err = fn(id, *v)
+		}
+	}
+	u32 := func(id PropertyID, v *uint32) {
+		if err == nil && v != nil {
+			err = fn(id, *v)
+		}
+	}
+	str := func(id PropertyID, v string) {
+		if err == nil && v != "" {
+			err = fn(id, v)
+		}
+	}
+	bin := func(id PropertyID, v []byte) {
+		if err == nil && v != nil {
+			err = fn(id, v)
+		}
+	}
+
+	u8(PropPayloadFormatIndicator, p.PayloadFormatIndicator)
+	u32(PropMessageExpiryInterval, p.MessageExpiryInterval)
+	str(PropContentType, p.ContentType)
+	str(PropResponseTopic, p.ResponseTopic)
+	bin(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		if err == nil {
+			err = fn(PropSubscriptionIdentifier, varInt(id))
+		}
+	}
+	u32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	str(PropAssignedClientIdentifier, p.AssignedClientIdentifier)
+	u16(PropServerKeepAlive, p.ServerKeepAlive)
+	str(PropAuthenticationMethod, p.AuthenticationMethod)
+	bin(PropAuthenticationData, p.AuthenticationData)
+	u8(PropRequestProblemInformation, p.RequestProblemInformation)
+	u32(PropWillDelayInterval, p.WillDelayInterval)
+	u8(PropRequestResponseInformation, p.RequestResponseInformation)
+	str(PropResponseInformation, p.ResponseInformation)
+	str(PropServerReference, p.ServerReference)
+	str(PropReasonString, p.ReasonString)
+	u16(PropReceiveMaximum, p.ReceiveMaximum)
+	u16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	u16(PropTopicAlias, p.TopicAlias)
+	u8(PropMaximumQoS, p.MaximumQoS)
+	u8(PropRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		if err == nil {
+			err = fn(PropUserProperty, up)
+		}
+	}
+	u32(PropMaximumPacketSize, p.MaximumPacketSize)
+	u8(PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	u8(PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	u8(PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+	return err
+}
+
+// size is the length of the encoded properties without the length prefix.
+func (p *Properties) size() int {
+	var n int
+	_ = p.each(func(id PropertyID, v interface{}) error {
+		n += bitsLen // identifier
+		switch v := v.(type) {
+		case uint8:
+			n += bitsLen
+		case uint16:
+			n += integerLen
+		case uint32:
+			n += integer32Len
+		case varInt:
+			n += varIntLen(int(v))
+		case string:
+			n += stringLen(v)
+		case []byte:
+			n += bytesLen(v)
+		case UserProperty:
+			n += stringLen(v.Key) + stringLen(v.Value)
+		default:
+			panic(fmt.Sprintf("unknown property type %T", v))
+		}
+		return nil
+	})
+	return n
+}
+
+// len is the length of the encoded properties including the length prefix.
+func (p *Properties) len() int {
+	n := p.size()
+	return varIntLen(n) + n
+}
+
+// empty reports whether no properties are set.
+func (p *Properties) empty() bool {
+	return p.size() == 0
+}
+
+func (p *Properties) encode(e Encoder) error {
+	if err := e.VarInt(uint32(p.size())); err != nil {
+		return err
+	}
+	return p.each(func(id PropertyID, v interface{}) error {
+		if err := e.Bits(uint8(id)); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case uint8:
+			return e.Bits(v)
+		case uint16:
+			return e.Integer(v)
+		case uint32:
+			return e.Integer32(v)
+		case varInt:
+			return e.VarInt(uint32(v))
+		case string:
+			return e.String(v)
+		case []byte:
+			return e.Bytes(v)
+		case UserProperty:
+			if err := e.String(v.Key); err != nil {
+				return err
+			}
+			return e.String(v.Value)
+		default:
+			panic(fmt.Sprintf("unknown property type %T", v))
+		}
+	})
+}
+
+func (p *Properties) decode(d Decoder) error {
+	n, err := d.VarInt()
+	if err != nil {
+		return err
+	}
+	if int(n) > d.Len() {
+		return fmt.Errorf("malformed properties, len=%d want=%d", d.Len(), n)
+	}
+	end := d.Len() - int(n)
+	for d.Len() > end {
+		id, err := d.VarInt()
+		if err != nil {
+			return err
+		}
+		switch PropertyID(id) {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator, err = decodeUint8(d)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval, err = decodeUint32(d)
+		case PropContentType:
+			p.ContentType, err = d.String()
+		case PropResponseTopic:
+			p.ResponseTopic, err = d.String()
+		case PropCorrelationData:
+			p.CorrelationData, err = d.Bytes()
+		case PropSubscriptionIdentifier:
+			var v uint32
+			if v, err = d.VarInt(); err == nil {
+				p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, v)
+			}
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = decodeUint32(d)
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier, err = d.String()
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = decodeUint16(d)
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod, err = d.String()
+		case PropAuthenticationData:
+			p.AuthenticationData, err = d.Bytes()
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation, err = decodeUint8(d)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = decodeUint32(d)
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation, err = decodeUint8(d)
+		case PropResponseInformation:
+			p.ResponseInformation, err = d.String()
+		case PropServerReference:
+			p.ServerReference, err = d.String()
+		case PropReasonString:
+			p.ReasonString, err = d.String()
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = decodeUint16(d)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = decodeUint16(d)
+		case PropTopicAlias:
+			p.TopicAlias, err = decodeUint16(d)
+		case PropMaximumQoS:
+			p.MaximumQoS, err = decodeUint8(d)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = decodeUint8(d)
+		case PropUserProperty:
+			var up UserProperty
+			if up.Key, err = d.String(); err != nil {
+				return err
+			}
+			if up.Value, err = d.String(); err == nil {
+				p.UserProperties = append(p.UserProperties, up)
+			}
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = decodeUint32(d)
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable, err = decodeUint8(d)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable, err = decodeUint8(d)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable, err = decodeUint8(d)
+		default:
+			return fmt.Errorf("unknown property 0x%02x", id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.Len() != end {
+		return fmt.Errorf("malformed properties, len=%d want=%d", d.Len(), end)
+	}
+	return nil
+}
+
+func decodeUint8(d Decoder) (*uint8, error) {
+	v, err := d.Bits()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func decodeUint16(d Decoder) (*uint16, error) {
+	v, err := d.Integer()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func decodeUint32(d Decoder) (*uint32, error) {
+	v, err := d.Integer32()
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -1,23 +1,45 @@
 package packet
 
-import (
-	"fmt"
-)
+type PubackOption func(pk *Puback)
+
+func WithPubackReasonCode(rc ReasonCode) PubackOption {
+	return func(pk *Puback) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithPubackProperties(props Properties) PubackOption {
+	return func(pk *Puback) {
+		pk.Properties = props
+	}
+}
+
+func NewPuback(packetID uint16, opts ...PubackOption) *Puback {
+	pk := &Puback{
+		Flags:    pkPuback,
+		PacketID: packetID,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
 
 type Puback struct {
 	Flags
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (pk *Puback) Encode(e Encoder) error {
+	return encodeAck(e, pk.PacketID, pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Puback) Decode(d Decoder) error {
-	var err error
-	pk.PacketID, err = d.Integer()
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeAck(d, &pk.PacketID, &pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Puback) String() string {
-	return fmt.Sprintf("PUBACK (m%d)", pk.PacketID)
+	return ackString("PUBACK", pk.PacketID, pk.ReasonCode)
 }
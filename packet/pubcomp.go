@@ -1,23 +1,45 @@
 package packet
 
-import (
-	"fmt"
-)
+type PubcompOption func(pk *Pubcomp)
+
+func WithPubcompReasonCode(rc ReasonCode) PubcompOption {
+	return func(pk *Pubcomp) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithPubcompProperties(props Properties) PubcompOption {
+	return func(pk *Pubcomp) {
+		pk.Properties = props
+	}
+}
+
+func NewPubcomp(packetID uint16, opts ...PubcompOption) *Pubcomp {
+	pk := &Pubcomp{
+		Flags:    pkPubcomp,
+		PacketID: packetID,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
 
 type Pubcomp struct {
 	Flags
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (pk *Pubcomp) Encode(e Encoder) error {
+	return encodeAck(e, pk.PacketID, pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Pubcomp) Decode(d Decoder) error {
-	var err error
-	pk.PacketID, err = d.Integer()
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeAck(d, &pk.PacketID, &pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Pubcomp) String() string {
-	return fmt.Sprintf("PUBCOMP (m%d)", pk.PacketID)
+	return ackString("PUBCOMP", pk.PacketID, pk.ReasonCode)
 }
@@ -56,6 +56,12 @@ func WithPublishPayload(payload []byte) PublishOption {
 	}
 }
 
+func WithPublishProperties(props Properties) PublishOption {
+	return func(pk *Publish) {
+		pk.Properties = props
+	}
+}
+
 func NewPublish(topic string, opts ...PublishOption) *Publish {
 	pk := &Publish{
 		Flags: pkPublish,
@@ -72,15 +78,22 @@ type Publish struct {
 	Topic    string
 	Payload  []byte
 	PacketID uint16
+
+	// MQTT 5.0 only.
+	Properties Properties
 }
 
 func (pk *Publish) Encode(e Encoder) error {
 	nonZeroQoS := enabled(uint8(pk.Flags), PublishQoS1|PublishQoS2)
+	v5 := isV5(e.ProtocolLevel())
 
 	n := stringLen(pk.Topic)
 	if nonZeroQoS {
 		n += integerLen
 	}
+	if v5 {
+		n += pk.Properties.len()
+	}
 	if pk.Payload != nil {
 		n += len(pk.Payload)
 	}
@@ -97,6 +110,11 @@ func (pk *Publish) Encode(e Encoder) error {
 			return err
 		}
 	}
+	if v5 {
+		if err = pk.Properties.encode(e); err != nil {
+			return err
+		}
+	}
 	if pk.Payload != nil {
 		return e.Payload(pk.Payload)
 	}
@@ -115,6 +133,11 @@ func (pk *Publish) Decode(d Decoder) error {
 			return err
 		}
 	}
+	if isV5(d.ProtocolLevel()) {
+		if err = pk.Properties.decode(d); err != nil {
+			return err
+		}
+	}
 	pk.Payload, err = d.Payload()
 	if err != nil {
 		return err
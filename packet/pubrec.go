@@ -1,23 +1,45 @@
 package packet
 
-import (
-	"fmt"
-)
+type PubrecOption func(pk *Pubrec)
+
+func WithPubrecReasonCode(rc ReasonCode) PubrecOption {
+	return func(pk *Pubrec) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithPubrecProperties(props Properties) PubrecOption {
+	return func(pk *Pubrec) {
+		pk.Properties = props
+	}
+}
+
+func NewPubrec(packetID uint16, opts ...PubrecOption) *Pubrec {
+	pk := &Pubrec{
+		Flags:    pkPubrec,
+		PacketID: packetID,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
 
 type Pubrec struct {
 	Flags
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (pk *Pubrec) Encode(e Encoder) error {
+	return encodeAck(e, pk.PacketID, pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Pubrec) Decode(d Decoder) error {
-	var err error
-	pk.PacketID, err = d.Integer()
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeAck(d, &pk.PacketID, &pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Pubrec) String() string {
-	return fmt.Sprintf("PUBREC (m%d)", pk.PacketID)
+	return ackString("PUBREC", pk.PacketID, pk.ReasonCode)
 }
@@ -1,9 +1,5 @@
 package packet
 
-import (
-	"fmt"
-)
-
 type PubrelOption func(pk *Pubrel)
 
 func WithPubrelPacketID(id uint16) PubrelOption {
@@ -12,6 +8,18 @@ func WithPubrelPacketID(id uint16) PubrelOption {
 	}
 }
 
+func WithPubrelReasonCode(rc ReasonCode) PubrelOption {
+	return func(pk *Pubrel) {
+		pk.ReasonCode = rc
+	}
+}
+
+func WithPubrelProperties(props Properties) PubrelOption {
+	return func(pk *Pubrel) {
+		pk.Properties = props
+	}
+}
+
 func NewPubrel(packetID uint16, opts ...PubrelOption) *Pubrel {
 	pk := &Pubrel{
 		Flags:    pkPubrel | 0x02,
@@ -25,16 +33,19 @@ func NewPubrel(packetID uint16, opts ...PubrelOption) *Pubrel {
 
 type Pubrel struct {
 	Flags
-	PacketID uint16
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func (pk *Pubrel) Encode(e Encoder) error {
-	if err := e.Len(2); err != nil {
-		return err
-	}
-	return e.Integer(pk.PacketID)
+	return encodeAck(e, pk.PacketID, pk.ReasonCode, &pk.Properties)
+}
+
+func (pk *Pubrel) Decode(d Decoder) error {
+	return decodeAck(d, &pk.PacketID, &pk.ReasonCode, &pk.Properties)
 }
 
 func (pk *Pubrel) String() string {
-	return fmt.Sprintf("PUBREL (m%d)", pk.PacketID)
+	return ackString("PUBREL", pk.PacketID, pk.ReasonCode)
 }
@@ -0,0 +1,154 @@
+package packet
+
+import (
+	"fmt"
+)
+
+// ReasonCode is an MQTT 5.0 reason code, values below 0x80 indicate success.
+type ReasonCode uint8
+
+const (
+	Success                             ReasonCode = 0x00
+	NormalDisconnection                 ReasonCode = 0x00
+	GrantedQoS0                         ReasonCode = 0x00
+	GrantedQoS1                         ReasonCode = 0x01
+	GrantedQoS2                         ReasonCode = 0x02
+	DisconnectWithWillMessage           ReasonCode = 0x04
+	NoMatchingSubscribers               ReasonCode = 0x10
+	NoSubscriptionExisted               ReasonCode = 0x11
+	ContinueAuthentication              ReasonCode = 0x18
+	ReAuthenticate                      ReasonCode = 0x19
+	UnspecifiedError                    ReasonCode = 0x80
+	MalformedPacket                     ReasonCode = 0x81
+	ProtocolError                       ReasonCode = 0x82
+	ImplementationSpecificError         ReasonCode = 0x83
+	UnsupportedProtocolVersion          ReasonCode = 0x84
+	ClientIdentifierNotValid            ReasonCode = 0x85
+	BadUserNameOrPassword               ReasonCode = 0x86
+	NotAuthorized                       ReasonCode = 0x87
+	ServerUnavailable                   ReasonCode = 0x88
+	ServerBusy                          ReasonCode = 0x89
+	Banned                              ReasonCode = 0x8a
+	ServerShuttingDown                  ReasonCode = 0x8b
+	BadAuthenticationMethod             ReasonCode = 0x8c
+	KeepAliveTimeout                    ReasonCode = 0x8d
+	SessionTakenOver                    ReasonCode = 0x8e
+	TopicFilterInvalid                  ReasonCode = 0x8f
+	TopicNameInvalid                    ReasonCode = 0x90
+	PacketIdentifierInUse               ReasonCode = 0x91
+	PacketIdentifierNotFound            ReasonCode = 0x92
+	ReceiveMaximumExceeded              ReasonCode = 0x93
+	TopicAliasInvalid                   ReasonCode = 0x94
+	PacketTooLarge                      ReasonCode = 0x95
+	MessageRateTooHigh                  ReasonCode = 0x96
+	QuotaExceeded                       ReasonCode = 0x97
+	AdministrativeAction                ReasonCode = 0x98
+	PayloadFormatInvalid                ReasonCode = 0x99
+	RetainNotSupported                  ReasonCode = 0x9a
+	QoSNotSupported                     ReasonCode = 0x9b
+	UseAnotherServer                    ReasonCode = 0x9c
+	ServerMoved                         ReasonCode = 0x9d
+	SharedSubscriptionsNotSupported     ReasonCode = 0x9e
+	ConnectionRateExceeded              ReasonCode = 0x9f
+	MaximumConnectTime                  ReasonCode = 0xa0
+	SubscriptionIdentifiersNotSupported ReasonCode = 0xa1
+	WildcardSubscriptionsNotSupported   ReasonCode = 0xa2
+)
+
+// Failed reports whether the reason code indicates a failure.
+func (rc ReasonCode) Failed() bool {
+	return rc >= 0x80
+}
+
+func (rc ReasonCode) String() string {
+	switch rc {
+	case Success:
+		return "success"
+	case GrantedQoS1:
+		return "granted qos 1"
+	case GrantedQoS2:
+		return "granted qos 2"
+	case DisconnectWithWillMessage:
+		return "disconnect with will message"
+	case NoMatchingSubscribers:
+		return "no matching subscribers"
+	case NoSubscriptionExisted:
+		return "no subscription existed"
+	case ContinueAuthentication:
+		return "continue authentication"
+	case ReAuthenticate:
+		return "re-authenticate"
+	case UnspecifiedError:
+		return "unspecified error"
+	case MalformedPacket:
+		return "malformed packet"
+	case ProtocolError:
+		return "protocol error"
+	case ImplementationSpecificError:
+		return "implementation specific error"
+	case UnsupportedProtocolVersion:
+		return "unsupported protocol version"
+	case ClientIdentifierNotValid:
+		return "client identifier not valid"
+	case BadUserNameOrPassword:
+		return "bad user name or password"
+	case NotAuthorized:
+		return "not authorized"
+	case ServerUnavailable:
+		return "server unavailable"
+	case ServerBusy:
+		return "server busy"
+	case Banned:
+		return "banned"
+	case ServerShuttingDown:
+		return "server shutting down"
+	case BadAuthenticationMethod:
+		return "bad authentication method"
+	case KeepAliveTimeout:
+		return "keep alive timeout"
+	case SessionTakenOver:
+		return "session taken over"
+	case TopicFilterInvalid:
+		return "topic filter invalid"
+	case TopicNameInvalid:
+		return "topic name invalid"
+	case PacketIdentifierInUse:
+		return "packet identifier in use"
+	case PacketIdentifierNotFound:
+		return "packet identifier not found"
+	case ReceiveMaximumExceeded:
+		return "receive maximum exceeded"
+	case TopicAliasInvalid:
+		return "topic alias invalid"
+	case PacketTooLarge:
+		return "packet too large"
+	case MessageRateTooHigh:
+		return "message rate too high"
+	case QuotaExceeded:
+		return "quota exceeded"
+	case AdministrativeAction:
+		return "administrative action"
+	case PayloadFormatInvalid:
+		return "payload format invalid"
+	case RetainNotSupported:
+		return "retain not supported"
+	case QoSNotSupported:
+		return "qos not supported"
+	case UseAnotherServer:
+		return "use another server"
+	case ServerMoved:
+		return "server moved"
+	case SharedSubscriptionsNotSupported:
+		return "shared subscriptions not supported"
+	case ConnectionRateExceeded:
+		return "connection rate exceeded"
+	case MaximumConnectTime:
+		return "maximum connect time"
+	case SubscriptionIdentifiersNotSupported:
+		return "subscription identifiers not supported"
+	case WildcardSubscriptionsNotSupported:
+		return "wildcard subscriptions not supported"
+	default:
+		return fmt.Sprintf("unknown(0x%02x)", uint8(rc))
+	}
+}
@@ -14,10 +14,64 @@ const (
 	SubscriptionFailure = 0x80
 )
 
+type SubackOption func(pk *Suback)
+
+// WithSubackReturnCodes sets return codes in the order of subscription topics,
+// that are reason codes in case of MQTT 5.0.
+func WithSubackReturnCodes(rcs ...uint8) SubackOption {
+	return func(pk *Suback) {
+		pk.ReturnCodes = append(pk.ReturnCodes, rcs...)
+	}
+}
+
+func WithSubackProperties(props Properties) SubackOption {
+	return func(pk *Suback) {
+		pk.Properties = props
+	}
+}
+
+func NewSuback(packetID uint16, opts ...SubackOption) *Suback {
+	pk := &Suback{
+		Flags:    pkSuback,
+		PacketID: packetID,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
+
 type Suback struct {
 	Flags
-	PacketID    uint16
+	PacketID uint16
+
+	// ReturnCodes are MQTT 5.0 reason codes when the protocol level is 5.
 	ReturnCodes []uint8
+
+	// MQTT 5.0 only.
+	Properties Properties
+}
+
+func (pk *Suback) Encode(e Encoder) error {
+	v5 := isV5(e.ProtocolLevel())
+	n := integerLen + len(pk.ReturnCodes)
+	if v5 {
+		n += pk.Properties.len()
+	}
+
+	var err error
+	if err = e.Len(n); err != nil {
+		return err
+	}
+	if err = e.Integer(pk.PacketID); err != nil {
+		return err
+	}
+	if v5 {
+		if err = pk.Properties.encode(e); err != nil {
+			return err
+		}
+	}
+	return e.Payload(pk.ReturnCodes)
 }
 
 func (pk *Suback) Decode(d Decoder) error {
@@ -26,10 +80,17 @@ func (pk *Suback) Decode(d Decoder) error {
 	if err != nil {
 		return err
 	}
-	pk.ReturnCodes, err = d.Payload()
+	if isV5(d.ProtocolLevel()) {
+		if err = pk.Properties.decode(d); err != nil {
+			return err
+		}
+	}
+	b, err := d.Payload()
 	if err != nil {
 		return err
 	}
+	// the decoder reuses its buffer
+	pk.ReturnCodes = append([]byte(nil), b...)
 	return nil
 }
 
@@ -1,10 +1,19 @@
 package packet
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// MQTT 5.0 subscription options, the first two bits are occupied by the maximum QoS.
+const (
+	SubscribeNoLocal = 1 << (iota + 2)
+	SubscribeRetainAsPublished
+	SubscribeRetainHandling1
+	SubscribeRetainHandling2
+)
+
 type SubscribeOption func(pk *Subscribe)
 
 func WithSubscribePacketID(id uint16) SubscribeOption {
@@ -22,6 +31,23 @@ func WithSubscribeTopic(topic string, qos QoS) SubscribeOption {
 	}
 }
 
+// WithSubscribeTopicFlags is WithSubscribeTopic with raw subscription options byte,
+// that is QoS combined with SubscribeNoLocal and others.
+func WithSubscribeTopicFlags(topic string, flags uint8) SubscribeOption {
+	return func(pk *Subscribe) {
+		pk.Topics = append(pk.Topics, &SubscribeTopic{
+			Name:  topic,
+			Flags: flags,
+		})
+	}
+}
+
+func WithSubscribeProperties(props Properties) SubscribeOption {
+	return func(pk *Subscribe) {
+		pk.Properties = props
+	}
+}
+
 func NewSubscribe(opts ...SubscribeOption) *Subscribe {
 	pk := &Subscribe{
 		Flags: pkSubscribe | 0x02,
@@ -36,6 +62,9 @@ type Subscribe struct {
 	Flags
 	PacketID uint16
 	Topics   []*SubscribeTopic
+
+	// MQTT 5.0 only.
+	Properties Properties
 }
 
 type SubscribeTopic struct {
@@ -48,7 +77,11 @@ func (t *SubscribeTopic) String() string {
 }
 
 func (pk *Subscribe) Encode(e Encoder) error {
+	v5 := isV5(e.ProtocolLevel())
 	n := integerLen // PacketID
+	if v5 {
+		n += pk.Properties.len()
+	}
 	for _, topic := range pk.Topics {
 		n += stringLen(topic.Name) + bitsLen // Flags
 	}
@@ -60,6 +93,11 @@ func (pk *Subscribe) Encode(e Encoder) error {
 	if err = e.Integer(pk.PacketID); err != nil {
 		return err
 	}
+	if v5 {
+		if err = pk.Properties.encode(e); err != nil {
+			return err
+		}
+	}
 	for _, topic := range pk.Topics {
 		if err = e.String(topic.Name); err != nil {
 			return err
@@ -71,6 +109,32 @@ func (pk *Subscribe) Encode(e Encoder) error {
 	return nil
 }
 
+func (pk *Subscribe) Decode(d Decoder) error {
+	var err error
+	if pk.PacketID, err = d.Integer(); err != nil {
+		return err
+	}
+	if isV5(d.ProtocolLevel()) {
+		if err = pk.Properties.decode(d); err != nil {
+			return err
+		}
+	}
+	for d.Len() > 0 {
+		topic := &SubscribeTopic{}
+		if topic.Name, err = d.String(); err != nil {
+			return err
+		}
+		if topic.Flags, err = d.Bits(); err != nil {
+			return err
+		}
+		pk.Topics = append(pk.Topics, topic)
+	}
+	if len(pk.Topics) == 0 {
+		return errors.New("subscribe must contain at least one topic")
+	}
+	return nil
+}
+
 func (pk *Subscribe) String() string {
 	topics := make([]string, 0, len(pk.Topics))
 	for _, topic := range pk.Topics {
@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -19,6 +20,12 @@ func WithUnsubscribeTopic(topics ...string) UnsubscribeOption {
 	}
 }
 
+func WithUnsubscribeProperties(props Properties) UnsubscribeOption {
+	return func(pk *Unsubscribe) {
+		pk.Properties = props
+	}
+}
+
 func NewUnsubscribe(opts ...UnsubscribeOption) *Unsubscribe {
 	pk := &Unsubscribe{
 		Flags: pkUnsubscribe | 0x02,
@@ -33,10 +40,17 @@ type Unsubscribe struct {
 	Flags
 	PacketID uint16
 	Topics   []string
+
+	// MQTT 5.0 only.
+	Properties Properties
 }
 
 func (pk *Unsubscribe) Encode(e Encoder) error {
+	v5 := isV5(e.ProtocolLevel())
 	n := integerLen // PacketID
+	if v5 {
+		n += pk.Properties.len()
+	}
 	for _, topic := range pk.Topics {
 		n += stringLen(topic)
 	}
@@ -48,6 +62,11 @@ func (pk *Unsubscribe) Encode(e Encoder) error {
 	if err = e.Integer(pk.PacketID); err != nil {
 		return err
 	}
+	if v5 {
+		if err = pk.Properties.encode(e); err != nil {
+			return err
+		}
+	}
 	for _, topic := range pk.Topics {
 		if err = e.String(topic); err != nil {
 			return err
@@ -56,6 +75,29 @@ func (pk *Unsubscribe) Encode(e Encoder) error {
 	return nil
 }
 
+func (pk *Unsubscribe) Decode(d Decoder) error {
+	var err error
+	if pk.PacketID, err = d.Integer(); err != nil {
+		return err
+	}
+	if isV5(d.ProtocolLevel()) {
+		if err = pk.Properties.decode(d); err != nil {
+			return err
+		}
+	}
+	for d.Len() > 0 {
+		topic, err := d.String()
+		if err != nil {
+			return err
+		}
+		pk.Topics = append(pk.Topics, topic)
+	}
+	if len(pk.Topics) == 0 {
+		return errors.New("unsubscribe must contain at least one topic")
+	}
+	return nil
+}
+
 func (pk *Unsubscribe) String() string {
 	topics := make([]string, 0, len(pk.Topics))
 	for _, topic := range pk.Topics {
@@ -4,9 +4,59 @@ import (
 	"fmt"
 )
 
+type UnsubackOption func(pk *Unsuback)
+
+func WithUnsubackReasonCodes(rcs ...uint8) UnsubackOption {
+	return func(pk *Unsuback) {
+		pk.ReasonCodes = append(pk.ReasonCodes, rcs...)
+	}
+}
+
+func WithUnsubackProperties(props Properties) UnsubackOption {
+	return func(pk *Unsuback) {
+		pk.Properties = props
+	}
+}
+
+func NewUnsuback(packetID uint16, opts ...UnsubackOption) *Unsuback {
+	pk := &Unsuback{
+		Flags:    pkUnsuback,
+		PacketID: packetID,
+	}
+	for _, opt := range opts {
+		opt(pk)
+	}
+	return pk
+}
+
 type Unsuback struct {
 	Flags
 	PacketID uint16
+
+	// MQTT 5.0 only.
+	Properties  Properties
+	ReasonCodes []uint8
+}
+
+func (pk *Unsuback) Encode(e Encoder) error {
+	if !isV5(e.ProtocolLevel()) {
+		if err := e.Len(integerLen); err != nil {
+			return err
+		}
+		return e.Integer(pk.PacketID)
+	}
+
+	var err error
+	if err = e.Len(integerLen + pk.Properties.len() + len(pk.ReasonCodes)); err != nil {
+		return err
+	}
+	if err = e.Integer(pk.PacketID); err != nil {
+		return err
+	}
+	if err = pk.Properties.encode(e); err != nil {
+		return err
+	}
+	return e.Payload(pk.ReasonCodes)
 }
 
 func (pk *Unsuback) Decode(d Decoder) error {
@@ -15,6 +65,18 @@ func (pk *Unsuback) Decode(d Decoder) error {
 	if err != nil {
 		return err
 	}
+	if !isV5(d.ProtocolLevel()) {
+		return nil
+	}
+	if err = pk.Properties.decode(d); err != nil {
+		return err
+	}
+	b, err := d.Payload()
+	if err != nil {
+		return err
+	}
+	// the decoder reuses its buffer
+	pk.ReasonCodes = append([]byte(nil), b...)
 	return nil
 }
 
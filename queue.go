@@ -0,0 +1,564 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// OverflowPolicy defines what happens to messages that don't fit into a full buffer.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock makes the producer wait for free space.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest discards the oldest buffered message to make space.
+	OverflowDropOldest
+
+	// OverflowDropNewest discards the message that doesn't fit.
+	OverflowDropNewest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	default:
+		return fmt.Sprintf("policy(%d)", p)
+	}
+}
+
+// ErrQueueFull is returned when a message is dropped because the queue is full.
+var ErrQueueFull = errors.New("queue is full")
+
+// WithOfflineQueue makes Publish put messages into the queue when
+// the client is not connected instead of waiting for a connection,
+// queued messages are published in order after reconnect.
+//
+// It has effect only on clients created with NewWithDialer.
+func WithOfflineQueue(q *Queue) Option {
+	return func(c *Client) {
+		c.queue = q
+	}
+}
+
+// QueueOption is a queue configuration option.
+type QueueOption func(q *Queue) error
+
+// WithQueuePolicy sets the policy applied when the queue is full,
+// it's OverflowBlock by default.
+func WithQueuePolicy(policy OverflowPolicy) QueueOption {
+	return func(q *Queue) error {
+		q.policy = policy
+		return nil
+	}
+}
+
+// WithQueueSpill makes the queue write messages that don't fit in memory
+// to the append-only file at the given path, maxBytes limits the size of
+// messages that are not read yet. Messages left in the file by previous
+// runs are queued again, so they're not lost across restarts.
+func WithQueueSpill(path string, maxBytes int64) QueueOption {
+	return func(q *Queue) error {
+		s, err := openSpill(path, maxBytes)
+		if err != nil {
+			return err
+		}
+		q.spill = s
+		return nil
+	}
+}
+
+// NewQueue creates a queue that keeps up to size messages in memory.
+func NewQueue(size int, opts ...QueueOption) (*Queue, error) {
+	if size < 1 {
+		return nil, errors.New("queue size must be positive")
+	}
+	q := &Queue{
+		size:    size,
+		changed: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			if q.spill != nil {
+				q.spill.close()
+			}
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Queue is a bounded FIFO queue of outgoing messages.
+type Queue struct {
+	mu      sync.Mutex
+	size    int
+	policy  OverflowPolicy
+	mem     []queueEntry
+	spill   *spill
+	spilled []func(err error) // done functions of messages spilled by this run
+	dropped uint64
+	changed chan struct{} // closed and replaced every time the queue changes
+}
+
+// queueEntry is a queued message along with the function
+// called with the result of publishing it, if any.
+type queueEntry struct {
+	publish *packet.Publish
+	done    func(err error)
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.mem)
+	if q.spill != nil {
+		n += q.spill.n
+	}
+	return n
+}
+
+// Dropped returns the number of messages discarded by the overflow policy.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// Close closes the spill file if any.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill != nil {
+		return q.spill.close()
+	}
+	return nil
+}
+
+func (q *Queue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// push appends the message to the queue applying the overflow policy,
+// done is called with the result of publishing it once it's sent.
+// It returns done functions of older messages discarded to make space,
+// nil ones included, the caller completes them outside the lock.
+func (q *Queue) push(
+	ctx context.Context, publish *packet.Publish, done func(err error),
+) ([]func(err error), error) {
+	var b []byte
+	if q.spill != nil {
+		var err error
+		if b, err = marshalPacket(publish); err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var dropped []func(err error)
+	for {
+		// once messages are spilled new ones go after them to keep the order
+		if (q.spill == nil || q.spill.n == 0) && len(q.mem) < q.size {
+			q.mem = append(q.mem, queueEntry{publish: publish, done: done})
+			q.notify()
+			return dropped, nil
+		}
+		if q.spill != nil && q.spill.fits(b) {
+			if err := q.spill.append(b); err != nil {
+				return dropped, err
+			}
+			q.spilled = append(q.spilled, done)
+			q.notify()
+			return dropped, nil
+		}
+
+		switch q.policy {
+		case OverflowDropNewest:
+			q.dropped++
+			return dropped, ErrQueueFull
+		case OverflowDropOldest:
+			e, err := q.shift()
+			if err != nil {
+				return dropped, err
+			}
+			q.dropped++
+			dropped = append(dropped, e.done)
+			continue
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+			q.mu.Lock()
+		case <-ctx.Done():
+			q.mu.Lock()
+			return dropped, ctx.Err()
+		}
+	}
+}
+
+// unshift puts the popped message back to the head of the queue,
+// it may exceed the size for a while to keep the message.
+// A spilled message stays in the file until commit is called.
+func (q *Queue) unshift(publish *packet.Publish, done func(err error)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.mem = append([]queueEntry{{publish: publish, done: done}}, q.mem...)
+	q.notify()
+}
+
+// pop removes the oldest message from the queue and returns it
+// along with its done function, it blocks until there's one
+// or done is closed.
+func (q *Queue) pop(done <-chan struct{}) (*packet.Publish, func(err error), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		e, err := q.shift()
+		if err != nil || e.publish != nil {
+			return e.publish, e.done, err
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+			q.mu.Lock()
+		case <-done:
+			q.mu.Lock()
+			return nil, nil, errClosed
+		}
+	}
+}
+
+// commit is called when the popped message is handed over to the connection,
+// from then on spilled messages read so far are not read again after restarts.
+func (q *Queue) commit() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spill == nil {
+		return nil
+	}
+	return q.spill.commit()
+}
+
+// shift removes the oldest message, the publish is nil when the queue is empty.
+func (q *Queue) shift() (queueEntry, error) {
+	if len(q.mem) != 0 {
+		e := q.mem[0]
+		q.mem[0] = queueEntry{}
+		q.mem = q.mem[1:]
+		q.notify()
+		return e, nil
+	}
+	if q.spill == nil || q.spill.n == 0 {
+		return queueEntry{}, nil
+	}
+
+	// messages left by previous runs go first and have no done functions
+	var e queueEntry
+	if len(q.spilled) == q.spill.n {
+		e.done = q.spilled[0]
+		q.spilled[0] = nil
+		q.spilled = q.spilled[1:]
+	}
+	b, err := q.spill.next()
+	if err != nil {
+		return e, err
+	}
+	q.notify()
+	pk, err := unmarshalPacket(Outgoing, b)
+	if err != nil {
+		return e, err
+	}
+	publish, ok := pk.(*packet.Publish)
+	if !ok {
+		return e, fmt.Errorf("unexpected queued packet: %s", pk)
+	}
+	e.publish = publish
+	return e, nil
+}
+
+// spill is an append-only file of length-prefixed messages that starts
+// with the offset of the next uncommitted message, so messages are not read
+// twice after restarts, the file is truncated once all of them are committed.
+type spill struct {
+	f    *os.File
+	path string
+	max  int64
+	size int64 // the file size
+	off  int64 // the offset of the next uncommitted message saved in the header
+	rd   int64 // the offset of the next unread message
+	n    int   // the number of unread messages
+}
+
+const spillHeaderLen = 8
+
+func openSpill(path string, max int64) (*spill, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &spill{f: f, path: path, max: max}
+	if err = s.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan counts messages left from previous runs,
+// cutting off a partially written one if any.
+func (s *spill) scan() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < spillHeaderLen {
+		return s.reset()
+	}
+	var off [spillHeaderLen]byte
+	if _, err = s.f.ReadAt(off[:], 0); err != nil {
+		return err
+	}
+	s.off = int64(binary.BigEndian.Uint64(off[:]))
+	if s.off < spillHeaderLen || s.off > fi.Size() {
+		return fmt.Errorf("corrupted queue file %q", s.path)
+	}
+	s.size, s.rd = s.off, s.off
+
+	var hdr [4]byte
+	for {
+		if _, err = s.f.ReadAt(hdr[:], s.size); err != nil {
+			break
+		}
+		end := s.size + int64(len(hdr)) + int64(binary.BigEndian.Uint32(hdr[:]))
+		if end > fi.Size() {
+			break
+		}
+		s.size = end
+		s.n++
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return s.f.Truncate(s.size)
+}
+
+func (s *spill) fits(b []byte) bool {
+	return s.size-s.rd+int64(4+len(b)) <= s.max
+}
+
+func (s *spill) append(b []byte) error {
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	if _, err := s.f.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	s.size += int64(len(buf))
+	s.n++
+	return nil
+}
+
+func (s *spill) next() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := s.f.ReadAt(hdr[:], s.rd); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := s.f.ReadAt(b, s.rd+int64(len(hdr))); err != nil {
+		return nil, err
+	}
+	s.rd += int64(len(hdr) + len(b))
+	s.n--
+	return b, nil
+}
+
+// commit saves the read offset in the header.
+func (s *spill) commit() error {
+	switch {
+	case s.off == s.rd:
+		return nil
+	case s.n == 0:
+		return s.reset()
+	case s.rd > s.max:
+		return s.compact()
+	default:
+		var off [spillHeaderLen]byte
+		binary.BigEndian.PutUint64(off[:], uint64(s.rd))
+		if _, err := s.f.WriteAt(off[:], 0); err != nil {
+			return err
+		}
+		s.off = s.rd
+		return nil
+	}
+}
+
+// reset truncates the file leaving only the header.
+func (s *spill) reset() error {
+	var off [spillHeaderLen]byte
+	binary.BigEndian.PutUint64(off[:], spillHeaderLen)
+	if err := s.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.f.WriteAt(off[:], 0); err != nil {
+		return err
+	}
+	s.size, s.off, s.rd = spillHeaderLen, spillHeaderLen, spillHeaderLen
+	return nil
+}
+
+// compact replaces the file with one containing only unread messages,
+// so it doesn't grow indefinitely when it's never drained completely.
+func (s *spill) compact() error {
+	b := make([]byte, spillHeaderLen+s.size-s.rd)
+	binary.BigEndian.PutUint64(b, spillHeaderLen)
+	if _, err := s.f.ReadAt(b[spillHeaderLen:], s.rd); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.f.Close()
+	s.f, s.size, s.off, s.rd = f, int64(len(b)), spillHeaderLen, spillHeaderLen
+	return nil
+}
+
+func (s *spill) close() error {
+	return s.f.Close()
+}
+
+// enqueue reports whether a message has to be queued, that is when
+// the client is not connected or older messages are still queued.
+func (c *Client) enqueue() bool {
+	if c.queue == nil || c.dialer == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.queued != 0 {
+		c.queued++
+		return true
+	}
+	return false
+}
+
+// dequeued is called when a queued message is sent or discarded.
+func (c *Client) dequeued() {
+	c.mu.Lock()
+	c.queued--
+	c.mu.Unlock()
+}
+
+// flush publishes queued messages in order until the client is closed,
+// QoS 1 and QoS 2 flows are completed in the background.
+func (c *Client) flush() {
+	var attempt int
+	for {
+		// messages stay in the queue while the client is disconnected
+		if _, err := c.ready(c.ctx); err != nil {
+			return
+		}
+		publish, done, err := c.queue.pop(c.done)
+		if err != nil {
+			if err != errClosed {
+				c.logf("queue error: %s", err)
+			}
+			return
+		}
+		if err = c.publishQueued(publish, done); err == nil {
+			if err = c.queue.commit(); err != nil {
+				c.logf("queue error: %s", err)
+			}
+			attempt = 0
+			continue
+		}
+
+		// the message is not sent, so it goes back to be retried
+		c.queue.unshift(publish, done)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.logf("queued publish failed: %s", err)
+		t := time.NewTimer(c.backoff.Delay(attempt))
+		select {
+		case <-t.C:
+			attempt++
+		case <-c.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// publishQueued sends the popped message, it's considered dequeued only
+// when it's handed over to the connection, otherwise the caller has to
+// put it back to the queue. done is called when the QoS flow is complete.
+func (c *Client) publishQueued(publish *packet.Publish, done func(err error)) error {
+	if !enabled(publish.Flags, packet.PublishQoS1|packet.PublishQoS2) {
+		if err := c.send(c.ctx, publish); err != nil {
+			return err
+		}
+		c.dequeued()
+		if done != nil {
+			done(nil)
+		}
+		return nil
+	}
+
+	var ackc <-chan packet.IncomingPacket
+	var err error
+	id := publish.PacketID
+	publish.PacketID, ackc, err = c.acquirePublish(c.ctx, id)
+	if err != nil {
+		publish.PacketID = id
+		return err
+	}
+	if err = c.sendTracked(c.ctx, publish.PacketID, publish); err != nil {
+		c.releasePublish(publish.PacketID)
+		if derr := c.store.Delete(Outgoing, publish.PacketID); derr != nil {
+			c.logf("store error: %s", derr)
+		}
+		publish.PacketID = id
+		return err
+	}
+	c.dequeued()
+	go func() {
+		err := <-c.finish(publish, ackc)
+		if done != nil {
+			done(err)
+		} else if err != nil {
+			c.logf("queued publish failed: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,250 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestQueueSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue")
+
+	q, err := NewQueue(2, WithQueueSpill(path, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, 0, 5)
+	if n := q.Len(); n != 5 {
+		t.Fatalf("len = %d, want 5", n)
+	}
+	pop(t, q, 0, 3)
+	push(t, q, 5, 7)
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages from memory are lost, spilled ones are not
+	if q, err = NewQueue(2, WithQueueSpill(path, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Len(); n != 4 {
+		t.Fatalf("len = %d, want 4", n)
+	}
+	pop(t, q, 3, 7)
+	if fi, err := os.Stat(path); err != nil || fi.Size() != spillHeaderLen {
+		t.Fatalf("drained file is not truncated: %v %v", fi, err)
+	}
+}
+
+func TestQueueSpillUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue")
+
+	q, err := NewQueue(1, WithQueueSpill(path, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, 0, 3)
+	pop(t, q, 0, 1)
+
+	// the message is put back when it cannot be sent
+	publish, done, err := q.pop(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.unshift(publish, done)
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q, err = NewQueue(1, WithQueueSpill(path, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	pop(t, q, 1, 3)
+}
+
+func TestQueueOverflow(t *testing.T) {
+	q, err := NewQueue(2, WithQueuePolicy(OverflowDropNewest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, 0, 2)
+	if _, err = q.push(context.Background(), queued(2), nil); err != ErrQueueFull {
+		t.Fatalf("err = %v, want %v", err, ErrQueueFull)
+	}
+	pop(t, q, 0, 2)
+
+	if q, err = NewQueue(2, WithQueuePolicy(OverflowDropOldest)); err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, 0, 5)
+	pop(t, q, 3, 5)
+	if n := q.Dropped(); n != 3 {
+		t.Fatalf("dropped = %d, want 3", n)
+	}
+
+	if q, err = NewQueue(1); err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, 0, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = q.push(ctx, queued(1), nil); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := q.push(context.Background(), queued(1), nil)
+		errc <- err
+	}()
+	pop(t, q, 0, 1)
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	pop(t, q, 1, 2)
+}
+
+func TestOfflineQueue(t *testing.T) {
+	q, err := NewQueue(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make(chan *fakeServer, 1)
+	c := NewWithDialer(DialFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cc, sc := net.Pipe()
+		servers <- &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+		return cc, nil
+	}), WithOfflineQueue(q))
+	defer c.Close()
+
+	// published before connecting
+	for i := 0; i < 3; i++ {
+		if err = c.Publish(context.Background(), fmt.Sprint(i),
+			packet.WithPublishQoS(packet.QoS1),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background())
+		errc <- err
+	}()
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		publish, ok := s.recv().(*packet.Publish)
+		if !ok || publish.Topic != fmt.Sprint(i) {
+			t.Fatalf("publish %d expected, got %v", i, publish)
+		}
+		s.send(packet.NewPuback(publish.PacketID))
+	}
+}
+
+func TestOfflineQueueDropOldest(t *testing.T) {
+	q, err := NewQueue(1, WithQueuePolicy(OverflowDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make(chan *fakeServer, 1)
+	c := NewWithDialer(DialFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cc, sc := net.Pipe()
+		servers <- &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+		return cc, nil
+	}), WithOfflineQueue(q))
+	defer c.Close()
+
+	// only the last one is kept
+	for i := 0; i < 3; i++ {
+		if err = c.Publish(context.Background(), fmt.Sprint(i),
+			packet.WithPublishQoS(packet.QoS1),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background())
+		errc <- err
+	}()
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	publish, ok := s.recv().(*packet.Publish)
+	if !ok || publish.Topic != "2" {
+		t.Fatalf("publish 2 expected, got %v", publish)
+	}
+	s.send(packet.NewPuback(publish.PacketID))
+
+	// the queue is drained, so messages are not queued anymore
+	go func() {
+		errc <- c.Publish(context.Background(), "3", packet.WithPublishQoS(packet.QoS1))
+	}()
+	publish = s.recv().(*packet.Publish)
+	select {
+	case err = <-errc:
+		t.Fatalf("publish returned before PUBACK: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.send(packet.NewPuback(publish.PacketID))
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queued(i int) *packet.Publish {
+	return packet.NewPublish(fmt.Sprint(i))
+}
+
+func push(t *testing.T, q *Queue, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if _, err := q.push(context.Background(), queued(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pop(t *testing.T, q *Queue, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		publish, _, err := q.pop(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publish.Topic != fmt.Sprint(i) {
+			t.Fatalf("topic = %q, want %q", publish.Topic, fmt.Sprint(i))
+		}
+		if err = q.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
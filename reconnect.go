@@ -0,0 +1,286 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// Dialer establishes network connections to the server.
+type Dialer interface {
+	Dial(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+// DialFunc is an adapter to use ordinary functions as dialers.
+type DialFunc func(ctx context.Context) (io.ReadWriteCloser, error)
+
+func (f DialFunc) Dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	return f(ctx)
+}
+
+// Backoff computes delays between reconnection attempts,
+// the delay grows exponentially from Min to Max by Factor
+// and is randomized by +/- Jitter fraction of it.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+	Jitter float64
+}
+
+// DefaultBackoff is used by clients unless WithBackoff is provided.
+var DefaultBackoff = Backoff{
+	Min:    time.Second,
+	Max:    2 * time.Minute,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+// Delay returns the delay before the given attempt starting from zero.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(attempt))
+	if d > float64(b.Max) || math.IsInf(d, 0) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// WithBackoff sets delays between reconnection attempts.
+func WithBackoff(b Backoff) Option {
+	return func(c *Client) {
+		c.backoff = b
+	}
+}
+
+// NewWithDialer creates a client that establishes connections with the dialer,
+// when the connection is lost it keeps reconnecting until the client is closed.
+//
+// On reconnect it sends CONNECT with the options passed to Connect, restores
+// subscriptions unless the server has the session and retransmits packets
+// that are not acknowledged yet, PUBLISH packets have the DUP flag set.
+// Operations waiting for acknowledgements are not interrupted by reconnects.
+func NewWithDialer(dialer Dialer, opts ...Option) *Client {
+	c := makeClient(opts...)
+	c.dialer = dialer
+	if c.queue != nil {
+		c.queued = c.queue.Len() // left from previous runs
+		go c.flush()
+	}
+	return c
+}
+
+// connect establishes the first connection and starts reconnecting
+// every time it's lost from then on.
+func (c *Client) connect(
+	ctx context.Context, opts []packet.ConnectOption,
+) (*packet.Connack, error) {
+	c.mu.Lock()
+	if c.connecting {
+		c.mu.Unlock()
+		return nil, errors.New("already connected")
+	}
+	c.connecting = true
+	c.mu.Unlock()
+
+	cn, connack, err := c.establish(ctx, opts)
+	if err != nil {
+		c.mu.Lock()
+		c.connecting = false
+		c.mu.Unlock()
+		return connack, err
+	}
+	c.mu.Lock()
+	c.connectOpts = opts
+	c.mu.Unlock()
+	c.setReady(cn)
+	go c.supervise(cn)
+	return connack, nil
+}
+
+// establish dials a new connection and performs the handshake,
+// restores subscriptions if needed and retransmits pending packets,
+// the connection is not ready for sending other packets yet.
+//
+// When the dialer implements ServerReporter and the server is
+// unavailable it dials again as long as the dialer allows that.
+func (c *Client) establish(
+	ctx context.Context, opts []packet.ConnectOption,
+) (*conn, *packet.Connack, error) {
+	reporter, _ := c.dialer.(ServerReporter)
+	var (
+		cn      *conn
+		connack *packet.Connack
+	)
+	for {
+		rw, err := c.dialer.Dial(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		cn = c.start(rw)
+		connack, err = c.handshake(ctx, cn, packet.NewConnect(opts...))
+		if err == nil {
+			if reporter != nil {
+				reporter.Report(rw, nil)
+			}
+			break
+		}
+		cn.close(err)
+		if reporter == nil || ctx.Err() != nil {
+			return nil, connack, err
+		}
+		if !serverUnavailable(connack) {
+			// the server is fine, the next attempt starts over
+			// from the preferred one
+			reporter.Report(rw, nil)
+			return nil, connack, err
+		}
+		select {
+		case <-c.done:
+			return nil, connack, err
+		default:
+		}
+		if !reporter.Report(rw, err) {
+			return nil, connack, err
+		}
+		c.logf("connect failed, trying another server: %s", err)
+	}
+	if connack.AcknowledgeFlags&packet.AcknowledgeSessionPresent == 0 {
+		// the server has no state for us, QoS 2 messages received
+		// previously are not going to be released
+		c.inmu.Lock()
+		for id := range c.inbound {
+			if err := c.store.Delete(Incoming, id); err != nil {
+				c.logf("store error: %s", err)
+			}
+		}
+		c.inbound = make(map[uint16]struct{})
+		c.inmu.Unlock()
+		if err := c.resubscribe(ctx, cn); err != nil {
+			cn.close(err)
+			return nil, nil, err
+		}
+	}
+	if err := c.retransmit(ctx, cn); err != nil {
+		cn.close(err)
+		return nil, nil, err
+	}
+	return cn, connack, nil
+}
+
+// resubscribe restores all active subscriptions with a single SUBSCRIBE.
+func (c *Client) resubscribe(ctx context.Context, cn *conn) error {
+	c.mu.Lock()
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	opts := make([]packet.SubscribeOption, 0, len(topics))
+	for _, topic := range topics {
+		opts = append(opts, packet.WithSubscribeTopicFlags(topic, c.subs[topic]))
+	}
+	c.mu.Unlock()
+	if len(opts) == 0 {
+		return nil
+	}
+
+	id, ackc, err := c.acquire(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer c.inflight.delete(id)
+	subscribe := packet.NewSubscribe(append(opts, packet.WithSubscribePacketID(id))...)
+	if _, err = cn.send(ctx, &out{pk: subscribe, done: make(chan struct{})}); err != nil {
+		return err
+	}
+	select {
+	case pk := <-ackc:
+		suback, ok := pk.(*packet.Suback)
+		if !ok {
+			return unexpectedPacketError(pk)
+		}
+		for i, rc := range suback.ReturnCodes {
+			if rc >= packet.SubscriptionFailure && i < len(topics) {
+				c.logf("resubscribe to %q failed: %d", topics[i], rc)
+			}
+		}
+		return nil
+	case <-cn.done:
+		return cn.err
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retransmit resends unacknowledged packets in the original order.
+func (c *Client) retransmit(ctx context.Context, cn *conn) error {
+	for _, pk := range c.inflight.pending() {
+		if publish, ok := pk.(*packet.Publish); ok {
+			dup := *publish
+			dup.Flags |= packet.PublishDup
+			pk = &dup
+		}
+		if _, err := cn.send(ctx, &out{pk: pk, done: make(chan struct{})}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supervise waits for the connection to be lost and reconnects with backoff.
+func (c *Client) supervise(cn *conn) {
+	for {
+		select {
+		case <-cn.done:
+		case <-c.done:
+			return
+		}
+		// the connection may be closed by its user directly,
+		// so make sure it's not used for sending anymore
+		c.lost(cn, nil)
+
+		// wait for the transmitter to be done so all the
+		// packets that have been sent over cn are tracked
+		<-cn.txdone
+
+		c.mu.Lock()
+		opts, stop := c.connectOpts, c.disconnecting
+		c.mu.Unlock()
+		if stop {
+			return
+		}
+		c.logf("connection lost: %s", cn.err)
+
+		for attempt := 0; ; attempt++ {
+			t := time.NewTimer(c.backoff.Delay(attempt))
+			select {
+			case <-t.C:
+			case <-c.done:
+				t.Stop()
+				return
+			}
+			next, _, err := c.establish(c.ctx, opts)
+			if err != nil {
+				c.logf("reconnect failed: %s", err)
+				continue
+			}
+			cn = next
+			c.setReady(cn)
+			break
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestReconnect(t *testing.T) {
+	c, servers := newReconnectingClient(t)
+	defer c.Close()
+
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Subscribe(context.Background(),
+			packet.WithSubscribeTopic("a/#", packet.QoS1),
+		)
+		errc <- err
+	}()
+	subscribe, ok := s.recv().(*packet.Subscribe)
+	if !ok {
+		t.Fatal("subscribe expected")
+	}
+	s.send(packet.NewSuback(subscribe.PacketID,
+		packet.WithSubackReturnCodes(packet.SubscriptionMaxQoS1),
+	))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		errc <- c.Publish(context.Background(), "a/b",
+			packet.WithPublishQoS(packet.QoS1),
+			packet.WithPublishPacketID(10),
+		)
+	}()
+	go func() {
+		errc <- c.Publish(context.Background(), "a/c",
+			packet.WithPublishQoS(packet.QoS2),
+			packet.WithPublishPacketID(20),
+		)
+	}()
+	s.recvPublishes(2)
+	s.send(packet.NewPubrec(20))
+	s.expect(packet.NewPubrel(20))
+	s.conn.Close()
+
+	// no session on the server side
+	s = <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	subscribe, ok = s.recv().(*packet.Subscribe)
+	if !ok || subscribe.Topics[0].Name != "a/#" {
+		t.Fatalf("resubscribe expected, got %s", subscribe)
+	}
+	s.send(packet.NewSuback(subscribe.PacketID,
+		packet.WithSubackReturnCodes(packet.SubscriptionMaxQoS1),
+	))
+	if publish := s.recvPublishes(1)[10]; !enabled(publish.Flags, packet.PublishDup) {
+		t.Fatal("retransmitted publish has no dup flag")
+	}
+	s.expect(packet.NewPubrel(20))
+	s.conn.Close()
+
+	// session is present
+	s = <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack(packet.WithConnackSessionPresent(true)))
+	s.recvPublishes(1)
+	s.expect(packet.NewPubrel(20))
+	s.send(packet.NewPuback(10))
+	s.send(packet.NewPubcomp(20))
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// new operations go through the current connection
+	go func() {
+		errc <- c.Publish(context.Background(), "a/d")
+	}()
+	s.recvPublishes(1)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectSubscribe(t *testing.T) {
+	c, servers := newReconnectingClient(t)
+	defer c.Close()
+
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := c.Subscribe(context.Background(),
+			packet.WithSubscribeTopic("a", packet.QoS1),
+		)
+		errc <- err
+	}()
+	subscribe, ok := s.recv().(*packet.Subscribe)
+	if !ok {
+		t.Fatal("subscribe expected")
+	}
+
+	// make sure the write is complete before the connection is dropped
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+
+	// the connection is lost before SUBACK
+	s = <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack(packet.WithConnackSessionPresent(true)))
+	s.expect(subscribe)
+	s.send(packet.NewSuback(subscribe.PacketID,
+		packet.WithSubackReturnCodes(packet.SubscriptionMaxQoS1),
+	))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		errc <- c.Unsubscribe(context.Background(), packet.WithUnsubscribeTopic("a"))
+	}()
+	unsubscribe, ok := s.recv().(*packet.Unsubscribe)
+	if !ok {
+		t.Fatal("unsubscribe expected")
+	}
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+
+	s = <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack(packet.WithConnackSessionPresent(true)))
+	s.expect(unsubscribe)
+	s.send(packet.NewUnsuback(unsubscribe.PacketID))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newReconnectingClient(t *testing.T, opts ...Option) (*Client, <-chan *fakeServer) {
+	t.Helper()
+	servers := make(chan *fakeServer, 1)
+	c := NewWithDialer(DialFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cc, sc := net.Pipe()
+		servers <- &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+		return cc, nil
+	}), append([]Option{WithBackoff(Backoff{Min: time.Millisecond, Max: time.Millisecond})}, opts...)...)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), packet.WithConnectClientID("test"))
+		errc <- err
+	}()
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	s.conn.Close()
+	return c, servers
+}
+
+func (s *fakeServer) expectConnect() *packet.Connect {
+	s.t.Helper()
+	connect, ok := s.recv().(*packet.Connect)
+	if !ok {
+		s.t.Fatal("connect expected")
+	}
+	return connect
+}
+
+// recvPublishes receives n publish packets in any order and maps them by packet id.
+func (s *fakeServer) recvPublishes(n int) map[uint16]*packet.Publish {
+	s.t.Helper()
+	m := make(map[uint16]*packet.Publish, n)
+	for i := 0; i < n; i++ {
+		publish, ok := s.recv().(*packet.Publish)
+		if !ok {
+			s.t.Fatal("publish expected")
+		}
+		m[publish.PacketID] = publish
+	}
+	return m
+}
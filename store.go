@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// Direction distinguishes packets sent by the client from received ones.
+type Direction uint8
+
+const (
+	// Outgoing are PUBLISH and PUBREL packets sent to the server
+	// and not acknowledged yet.
+	Outgoing Direction = iota
+
+	// Incoming are QoS 2 PUBLISH packets received from the server
+	// and not released yet.
+	Incoming
+)
+
+func (dir Direction) String() string {
+	switch dir {
+	case Outgoing:
+		return "outgoing"
+	case Incoming:
+		return "incoming"
+	default:
+		return fmt.Sprintf("direction(%d)", dir)
+	}
+}
+
+// Store persists in-flight packets keyed by their packet identifiers,
+// that makes it possible to complete QoS 1 and QoS 2 flows after restarts.
+//
+// Implementations have to be safe for concurrent use.
+type Store interface {
+	// Put stores the packet replacing the one with the same direction and id.
+	Put(dir Direction, id uint16, pk packet.Packet) error
+
+	// Delete removes the packet, it's not an error if it doesn't exist.
+	Delete(dir Direction, id uint16) error
+
+	// Load returns all packets of the given direction
+	// in the order they've been put in.
+	Load(dir Direction) ([]packet.Packet, error)
+
+	// Reset removes all packets.
+	Reset() error
+}
+
+// WithStore sets the store for in-flight packets, the client loads it
+// on the first Connect without the clean session flag and resends
+// pending packets, otherwise the store is reset.
+//
+// Packets are kept in memory by default that doesn't survive restarts.
+func WithStore(store Store) Option {
+	return func(c *Client) {
+		c.store = store
+	}
+}
+
+// storeKey identifies stored packets.
+type storeKey struct {
+	dir Direction
+	id  uint16
+}
+
+// NewMemoryStore creates a store that keeps packets in memory,
+// it can be shared between clients created one after another.
+func NewMemoryStore() Store {
+	return &memoryStore{m: make(map[storeKey]*record)}
+}
+
+type memoryStore struct {
+	mu  sync.Mutex
+	m   map[storeKey]*record
+	seq uint64
+}
+
+// record is a packet serialized to avoid sharing buffers with its owner.
+type record struct {
+	seq uint64
+	b   []byte
+}
+
+func (s *memoryStore) Put(dir Direction, id uint16, pk packet.Packet) error {
+	b, err := marshalPacket(pk)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.m[storeKey{dir, id}] = &record{seq: s.seq, b: b}
+	return nil
+}
+
+func (s *memoryStore) Delete(dir Direction, id uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, storeKey{dir, id})
+	return nil
+}
+
+func (s *memoryStore) Load(dir Direction) ([]packet.Packet, error) {
+	s.mu.Lock()
+	recs := make([]*record, 0, len(s.m))
+	for k, r := range s.m {
+		if k.dir == dir {
+			recs = append(recs, r)
+		}
+	}
+	s.mu.Unlock()
+	return unmarshalRecords(dir, recs)
+}
+
+func (s *memoryStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = make(map[storeKey]*record)
+	return nil
+}
+
+// unmarshalRecords decodes records sorted by their sequence numbers.
+func unmarshalRecords(dir Direction, recs []*record) ([]packet.Packet, error) {
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].seq < recs[j].seq
+	})
+	pks := make([]packet.Packet, 0, len(recs))
+	for _, r := range recs {
+		pk, err := unmarshalPacket(dir, r.b)
+		if err != nil {
+			return nil, err
+		}
+		pks = append(pks, pk)
+	}
+	return pks, nil
+}
+
+// marshalPacket encodes packets in MQTT 5.0 format
+// because it's a superset of 3.1.1 for stored packet types.
+func marshalPacket(pk packet.Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetProtocolLevel(packet.ProtocolLevel5)
+	if err := e.Encode(pk); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalPacket(dir Direction, b []byte) (packet.Packet, error) {
+	var d *Decoder
+	if dir == Outgoing {
+		d = NewServerDecoder(bytes.NewReader(b))
+	} else {
+		d = NewDecoder(bytes.NewReader(b))
+	}
+	d.SetProtocolLevel(packet.ProtocolLevel5)
+	pk, err := d.Decode()
+	if err != nil {
+		return nil, err
+	}
+	switch v := pk.(type) {
+	case *packet.Publish:
+		return v, nil
+	case *packet.Pubrel:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unexpected stored packet: %s", pk)
+	}
+}
+
+// packetID returns the identifier of a stored packet.
+func packetID(pk packet.Packet) uint16 {
+	switch v := pk.(type) {
+	case *packet.Publish:
+		return v.PacketID
+	case *packet.Pubrel:
+		return v.PacketID
+	default:
+		return 0
+	}
+}
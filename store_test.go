@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, mk := range map[string]func() (Store, error){
+		"memory": func() (Store, error) {
+			return NewMemoryStore(), nil
+		},
+		"file": func() (Store, error) {
+			return NewFileStore(dir)
+		},
+	} {
+		mk := mk
+		t.Run(name, func(t *testing.T) {
+			s, err := mk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			testStore(t, s)
+
+			// file stores are reopened to make sure the order is kept
+			if name == "file" {
+				if s, err = mk(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = s.Put(Outgoing, 3, packet.NewPubrel(3)); err != nil {
+				t.Fatal(err)
+			}
+			load(t, s, Outgoing, packet.NewPubrel(2), packet.NewPubrel(3))
+			if err = s.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			load(t, s, Outgoing)
+			load(t, s, Incoming)
+		})
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	pub1 := packet.NewPublish("a", packet.WithPublishPacketID(1),
+		packet.WithPublishQoS(packet.QoS1), packet.WithPublishPayload([]byte("1")))
+	pub2 := packet.NewPublish("b", packet.WithPublishPacketID(2),
+		packet.WithPublishQoS(packet.QoS2), packet.WithPublishPayload([]byte("2")))
+	for _, pk := range []packet.Packet{pub2, pub1} {
+		if err := s.Put(Outgoing, packetID(pk), pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(Incoming, 2, pub2); err != nil {
+		t.Fatal(err)
+	}
+	load(t, s, Outgoing, pub2, pub1)
+	load(t, s, Incoming, pub2)
+
+	// replaced packets go to the end
+	if err := s.Put(Outgoing, 2, packet.NewPubrel(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(Outgoing, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(Outgoing, 1); err != nil {
+		t.Fatal(err)
+	}
+	load(t, s, Outgoing, packet.NewPubrel(2))
+}
+
+func load(t *testing.T, s Store, dir Direction, want ...packet.Packet) {
+	t.Helper()
+	pks, err := s.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) == 0 {
+		want = []packet.Packet{}
+	}
+	if !reflect.DeepEqual(pks, want) {
+		t.Fatalf("%s = %v, want %v", dir, pks, want)
+	}
+}
+
+func TestStoreRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handled int
+	c, s := newPipeClient(t, WithStore(store), WithMessagesHandler(func(*packet.Publish) {
+		handled++
+	}))
+	connect(t, c, s, packet.NewConnack(), packet.WithConnectCleanSession(true))
+
+	go c.Publish(context.Background(), "a", packet.WithPublishQoS(packet.QoS2))
+	publish, ok := s.recv().(*packet.Publish)
+	if !ok {
+		t.Fatal("publish expected")
+	}
+	s.send(packet.NewPubrec(publish.PacketID))
+	s.expect(packet.NewPubrel(publish.PacketID))
+	s.send(packet.NewPublish("b", packet.WithPublishQoS(packet.QoS2), packet.WithPublishPacketID(7)))
+	s.expect(packet.NewPubrec(7))
+
+	// the process crashes
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = NewFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	c, s = newPipeClient(t, WithStore(store), WithMessagesHandler(func(*packet.Publish) {
+		handled++
+	}))
+	defer c.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), packet.WithConnectCleanSession(false))
+		errc <- err
+	}()
+	s.expectConnect()
+	s.send(packet.NewConnack(packet.WithConnackSessionPresent(true)))
+	s.expect(packet.NewPubrel(publish.PacketID))
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	s.send(packet.NewPublish("b", packet.WithPublishQoS(packet.QoS2), packet.WithPublishPacketID(7),
+		packet.WithPublishDup(true)))
+	s.expect(packet.NewPubrec(7))
+	s.send(packet.NewPubrel(7))
+	s.expect(packet.NewPubcomp(7))
+	if handled != 1 {
+		t.Fatalf("handled = %d, want 1", handled)
+	}
+	load(t, store, Incoming)
+
+	// the restored flow is completed in the background
+	s.send(packet.NewPubcomp(publish.PacketID))
+	for i := 0; ; i++ {
+		pks, err := store.Load(Outgoing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pks) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("outgoing = %v, want none", pks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// connect performs the handshake between the client and the fake server.
+func connect(
+	t *testing.T, c *Client, s *fakeServer, connack *packet.Connack, opts ...packet.ConnectOption,
+) {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background(), opts...)
+		errc <- err
+	}()
+	s.expectConnect()
+	s.send(connack)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// SubscribeChan subscribes to the topic filters and returns a subscription
+// that delivers matching messages to the channel with the given buffer size,
+// the policy defines what happens when the buffer is full.
+//
+// OverflowBlock stalls receiving of all packets until there's space in the
+// buffer, so consumers have to keep up with the rate of incoming messages.
+//
+// It fails without subscribing when any of the topic filters already
+// has a handler in the client's router, including other subscriptions.
+func (c *Client) SubscribeChan(
+	ctx context.Context, size int, policy OverflowPolicy, opts ...packet.SubscribeOption,
+) (*Subscription, error) {
+	ch := make(chan *packet.Publish, size)
+	s := &Subscription{
+		C:      ch,
+		client: c,
+		ch:     ch,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	for _, topic := range packet.NewSubscribe(opts...).Topics {
+		if c.mux.handle(muxFilter(topic.Name), s.deliver, false) != nil {
+			s.Close()
+			return nil, fmt.Errorf("topic filter %q is already handled", topic.Name)
+		}
+		s.filters = append(s.filters, topic.Name)
+	}
+	suback, err := c.Subscribe(ctx, opts...)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Suback = suback
+
+	// rejected filters are released for other handlers
+	granted := s.filters[:0]
+	for i, filter := range s.filters {
+		if i >= len(suback.ReturnCodes) || suback.ReturnCodes[i] >= packet.SubscriptionFailure {
+			c.mux.Remove(muxFilter(filter))
+			continue
+		}
+		granted = append(granted, filter)
+	}
+	s.filters = granted
+
+	// consumers ranging over the channel stop when the client is closed
+	go func() {
+		select {
+		case <-c.done:
+			s.close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+// Subscription is a set of subscribed topic filters which messages
+// are delivered to a channel, it's closed along with the client.
+type Subscription struct {
+	// C receives messages until the subscription is closed.
+	C <-chan *packet.Publish
+
+	// Suback is the server response to the subscription request.
+	Suback *packet.Suback
+
+	client  *Client
+	filters []string
+	ch      chan *packet.Publish
+	policy  OverflowPolicy
+	dropped uint64 // accessed atomically
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Dropped returns the number of messages discarded by the overflow policy.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) deliver(publish *packet.Publish) {
+	// workers pass copies already
+	if s.client.workers == nil {
+		publish = copyPublish(publish)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	for {
+		select {
+		case s.ch <- publish:
+			return
+		default:
+		}
+		switch s.policy {
+		case OverflowDropNewest:
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		case OverflowDropOldest:
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+				// the consumer has made space meanwhile
+			}
+			continue
+		}
+		select {
+		case s.ch <- publish:
+		case <-s.done:
+		}
+		return
+	}
+}
+
+// Unsubscribe unsubscribes from the topic filters and closes the subscription.
+func (s *Subscription) Unsubscribe(ctx context.Context) error {
+	// UNSUBSCRIBE must contain at least one topic filter
+	if len(s.filters) == 0 {
+		s.Close()
+		return nil
+	}
+	err := s.client.Unsubscribe(ctx, packet.WithUnsubscribeTopic(s.filters...))
+	s.Close()
+	return err
+}
+
+// Close stops delivering messages and closes the channel,
+// the client stays subscribed to the topic filters on the server.
+func (s *Subscription) Close() {
+	for _, filter := range s.filters {
+		s.client.mux.Remove(muxFilter(filter))
+	}
+	s.close()
+}
+
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
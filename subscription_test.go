@@ -0,0 +1,152 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestSubscribeChan(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	sub := subscribeChan(t, c, s, 2, OverflowDropOldest, "a/+")
+	for i := 0; i < 3; i++ {
+		s.send(packet.NewPublish(fmt.Sprintf("a/%d", i), packet.WithPublishPayload([]byte{byte(i)})))
+	}
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 3; i++ {
+		publish := <-sub.C
+		if publish.Topic != fmt.Sprintf("a/%d", i) || publish.Payload[0] != byte(i) {
+			t.Fatalf("unexpected message %s %v", publish, publish.Payload)
+		}
+	}
+	if n := sub.Dropped(); n != 1 {
+		t.Fatalf("dropped = %d, want 1", n)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sub.Unsubscribe(context.Background())
+	}()
+	unsubscribe, ok := s.recv().(*packet.Unsubscribe)
+	if !ok {
+		t.Fatal("unsubscribe expected")
+	}
+	s.send(packet.NewUnsuback(unsubscribe.PacketID))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = <-sub.C; ok {
+		t.Fatal("channel is not closed")
+	}
+
+	// subscriptions are closed along with the client
+	sub = subscribeChan(t, c, s, 1, OverflowDropNewest, "b")
+	s.send(packet.NewPublish("b"))
+	s.send(packet.NewPublish("b"))
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if n := sub.Dropped(); n != 1 {
+		t.Fatalf("dropped = %d, want 1", n)
+	}
+	c.Close()
+	var n int
+	for range sub.C {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("received %d messages, want 1", n)
+	}
+}
+
+func TestSubscribeChanDuplicate(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	sub := subscribeChan(t, c, s, 1, OverflowDropNewest, "a/+")
+	if _, err := c.SubscribeChan(context.Background(), 1, OverflowDropNewest,
+		packet.WithSubscribeTopic("$share/g/a/+", packet.QoS0),
+	); err == nil {
+		t.Fatal("error expected")
+	}
+
+	// the first subscription keeps receiving messages
+	s.send(packet.NewPublish("a/b"))
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if publish := <-sub.C; publish.Topic != "a/b" {
+		t.Fatalf("unexpected message %s", publish)
+	}
+}
+
+func TestSubscribeChanRejected(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	type result struct {
+		sub *Subscription
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		sub, err := c.SubscribeChan(context.Background(), 1, OverflowDropNewest,
+			packet.WithSubscribeTopic("a", packet.QoS0),
+		)
+		resc <- result{sub, err}
+	}()
+	subscribe, ok := s.recv().(*packet.Subscribe)
+	if !ok {
+		t.Fatal("subscribe expected")
+	}
+	s.send(packet.NewSuback(subscribe.PacketID,
+		packet.WithSubackReturnCodes(packet.SubscriptionFailure),
+	))
+	res := <-resc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	// nothing is sent, so the fake server doesn't have to read
+	if err := res.sub.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-res.sub.C; ok {
+		t.Fatal("channel is not closed")
+	}
+}
+
+func subscribeChan(
+	t *testing.T, c *Client, s *fakeServer, size int, policy OverflowPolicy, filter string,
+) *Subscription {
+	t.Helper()
+	type result struct {
+		sub *Subscription
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		sub, err := c.SubscribeChan(context.Background(), size, policy,
+			packet.WithSubscribeTopic(filter, packet.QoS0),
+		)
+		resc <- result{sub, err}
+	}()
+	subscribe, ok := s.recv().(*packet.Subscribe)
+	if !ok {
+		t.Fatal("subscribe expected")
+	}
+	s.send(packet.NewSuback(subscribe.PacketID,
+		packet.WithSubackReturnCodes(packet.SubscriptionMaxQoS0),
+	))
+	res := <-resc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	return res.sub
+}
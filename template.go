@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ParseTemplate parses a topic template where named parameters
+// like "dev/{id}/cmd/{action}" occupy entire topic levels, the template
+// compiles into the "dev/+/cmd/+" topic filter. Unnamed wildcards
+// '+' and '#' are allowed as well.
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{template: s}
+	levels := strings.Split(s, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "{}") {
+			continue
+		}
+		if len(level) < 2 || level[0] != '{' || level[len(level)-1] != '}' {
+			return nil, fmt.Errorf("invalid template %q: parameter %q must occupy the entire level", s, level)
+		}
+		name := level[1 : len(level)-1]
+		if name == "" || strings.ContainsAny(name, "{}+#") {
+			return nil, fmt.Errorf("invalid template %q: invalid parameter name %q", s, name)
+		}
+		for _, p := range t.params {
+			if p.name == name {
+				return nil, fmt.Errorf("invalid template %q: duplicate parameter %q", s, name)
+			}
+		}
+		t.params = append(t.params, param{name: name, level: i})
+		levels[i] = "+"
+	}
+	t.filter = strings.Join(levels, "/")
+	if err := ValidateTopicFilter(t.filter); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %s", s, err)
+	}
+	return t, nil
+}
+
+// MustParseTemplate is like ParseTemplate but panics when the template is invalid.
+func MustParseTemplate(s string) *Template {
+	t, err := ParseTemplate(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Template is a topic filter with named parameters.
+type Template struct {
+	template string
+	filter   string
+	params   []param
+}
+
+type param struct {
+	name  string
+	level int
+}
+
+// Filter returns the topic filter to subscribe to.
+func (t *Template) Filter() string {
+	return t.filter
+}
+
+func (t *Template) String() string {
+	return t.template
+}
+
+// Params matches the topic name and returns values of named parameters,
+// ok is false when the topic doesn't match the template.
+func (t *Template) Params(topic string) (params map[string]string, ok bool) {
+	if !Match(t.filter, topic) {
+		return nil, false
+	}
+	levels := strings.Split(topic, "/")
+	params = make(map[string]string, len(t.params))
+	for _, p := range t.params {
+		params[p.name] = levels[p.level]
+	}
+	return params, true
+}
+
+// Extract matches the topic name and stores values of named parameters
+// in fields of the struct v points to. Fields are looked up by the `topic`
+// tag or by names case-insensitively, they can be strings or integers.
+func (t *Template) Extract(topic string, v interface{}) error {
+	params, ok := t.Params(topic)
+	if !ok {
+		return fmt.Errorf("topic %q doesn't match template %q", topic, t.template)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot extract parameters into %T, a struct pointer expected", v)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Tag.Get("topic")
+		if name == "-" {
+			continue
+		}
+		s, ok := params[name]
+		if name == "" {
+			for k, v := range params {
+				if strings.EqualFold(k, f.Name) {
+					s, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(rv.Field(i), s); err != nil {
+			return fmt.Errorf("cannot set field %s: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func setField(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
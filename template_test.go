@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tpl, err := ParseTemplate("dev/{id}/cmd/{action}/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := tpl.Filter(), "dev/+/cmd/+/#"; have != want {
+		t.Errorf("Filter() = %q, want %q", have, want)
+	}
+
+	params, ok := tpl.Params("dev/42/cmd/play/x/y")
+	if !ok {
+		t.Fatal("topic doesn't match")
+	}
+	if want := map[string]string{"id": "42", "action": "play"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("Params() = %v, want %v", params, want)
+	}
+	if _, ok = tpl.Params("dev/42/status"); ok {
+		t.Error("unexpected match")
+	}
+
+	var v struct {
+		ID   uint32
+		Verb string `topic:"action"`
+		Skip string `topic:"-"`
+	}
+	if err = tpl.Extract("dev/42/cmd/play", &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 42 || v.Verb != "play" || v.Skip != "" {
+		t.Errorf("Extract() = %+v", v)
+	}
+	if err = tpl.Extract("dev/x/cmd/play", &v); err == nil {
+		t.Error("non-numeric id error expected")
+	}
+	if err = tpl.Extract("dev/42", &v); err == nil {
+		t.Error("mismatch error expected")
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, s := range []string{
+		"dev/{}/cmd",
+		"dev/{id/cmd",
+		"dev/id}/cmd",
+		"dev/x{id}/cmd",
+		"dev/{id}/{id}",
+		"dev/{i+d}",
+		"dev/#/{id}",
+		"",
+	} {
+		if _, err := ParseTemplate(s); err == nil {
+			t.Errorf("ParseTemplate(%q) error expected", s)
+		}
+	}
+}
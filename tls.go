@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// TLSOption is a TLS configuration option.
+type TLSOption func(*tls.Config) error
+
+// NewTLSConfig creates TLS configuration for WithTLSConfig,
+// connections require at least TLS 1.2 by default.
+//
+//	config, err := mqtt.NewTLSConfig(
+//		mqtt.WithTLSCAFile("ca.pem"),
+//		mqtt.WithTLSCertFile("client.pem", "client.key"),
+//	)
+func NewTLSConfig(opts ...TLSOption) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// WithTLSCAFile trusts certificates from the PEM bundle file
+// instead of the system certificate pool.
+func WithTLSCAFile(path string) TLSOption {
+	return func(config *tls.Config) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = WithTLSCA(b)(config); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	}
+}
+
+// WithTLSCA trusts certificates from the PEM bundle
+// instead of the system certificate pool.
+func WithTLSCA(pem []byte) TLSOption {
+	return func(config *tls.Config) error {
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found")
+		}
+		return nil
+	}
+}
+
+// WithTLSCertFile loads the client certificate and its private key from PEM files.
+func WithTLSCertFile(certFile, keyFile string) TLSOption {
+	return func(config *tls.Config) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+		return nil
+	}
+}
+
+// WithTLSCert sets the client certificate and its private key in PEM format.
+func WithTLSCert(certPEM, keyPEM []byte) TLSOption {
+	return func(config *tls.Config) error {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+		return nil
+	}
+}
+
+// WithTLSPKCS12File loads the client certificate with its private key and
+// intermediate certificates from the PKCS#12 (.p12, .pfx) file.
+func WithTLSPKCS12File(path, password string) TLSOption {
+	return func(config *tls.Config) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = WithTLSPKCS12(b, password)(config); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	}
+}
+
+// WithTLSPKCS12 sets the client certificate with its private key
+// and intermediate certificates from the PKCS#12 data.
+func WithTLSPKCS12(data []byte, password string) TLSOption {
+	return func(config *tls.Config) error {
+		key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return err
+		}
+		cert := tls.Certificate{
+			Certificate: [][]byte{leaf.Raw},
+			PrivateKey:  key,
+			Leaf:        leaf,
+		}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		config.Certificates = append(config.Certificates, cert)
+		return nil
+	}
+}
+
+// WithTLSServerName sets the server name sent in the SNI extension and
+// checked against the server certificate, by default it's the URL host.
+func WithTLSServerName(name string) TLSOption {
+	return func(config *tls.Config) error {
+		config.ServerName = name
+		return nil
+	}
+}
+
+// WithTLSMinVersion sets the minimum TLS version, e.g. tls.VersionTLS13.
+func WithTLSMinVersion(version uint16) TLSOption {
+	return func(config *tls.Config) error {
+		config.MinVersion = version
+		return nil
+	}
+}
+
+// WithTLSInsecure disables verification of the server certificate chain and
+// host name, connections are open to man-in-the-middle attacks unless
+// public keys are pinned with WithTLSPinnedKeys.
+func WithTLSInsecure() TLSOption {
+	return func(config *tls.Config) error {
+		config.InsecureSkipVerify = true
+		return nil
+	}
+}
+
+// WithTLSPinnedKeys requires one of the verified server certificates to have
+// one of the public keys, they are base64-encoded SHA-256 hashes of
+// DER-encoded SubjectPublicKeyInfo optionally prefixed with "sha256//".
+//
+// Only the server certificate is checked when verification is disabled.
+func WithTLSPinnedKeys(hashes ...string) TLSOption {
+	return func(config *tls.Config) error {
+		if len(hashes) == 0 {
+			return errors.New("no pinned keys given")
+		}
+		pins := make(map[[sha256.Size]byte]struct{}, len(hashes))
+		for _, h := range hashes {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(h, "sha256//"))
+			if err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("malformed pinned key %q", h)
+			}
+			var pin [sha256.Size]byte
+			copy(pin[:], b)
+			pins[pin] = struct{}{}
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			var certs []*x509.Certificate
+			for _, chain := range cs.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+			if len(certs) == 0 && len(cs.PeerCertificates) != 0 {
+				certs = cs.PeerCertificates[:1]
+			}
+			for _, cert := range certs {
+				if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+					return nil
+				}
+			}
+			return errors.New("tls: server public key is not pinned")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,220 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestDialTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", pki.serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config, err := NewTLSConfig(
+		WithTLSCAFile(pki.path("ca.pem")),
+		WithTLSCertFile(pki.path("client.pem"), pki.path("client.key")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := accept(t, l, nil)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := dialTest(t, servers, "ssl://localhost:"+port, nil, WithTLSConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.Close()
+
+	p12, err := pkcs12.Modern.Encode(pki.clientKey, pki.client, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := WithTLSCAFile(pki.path("ca.pem"))
+	clientCert := WithTLSCertFile(pki.path("client.pem"), pki.path("client.key"))
+	for name, run := range map[string]struct {
+		opts []TLSOption
+		ok   bool
+	}{
+		"pem":             {[]TLSOption{caCert, clientCert}, true},
+		"pkcs12":          {[]TLSOption{caCert, WithTLSPKCS12(p12, "secret")}, true},
+		"no client cert":  {[]TLSOption{caCert}, false},
+		"unknown ca":      {[]TLSOption{clientCert}, false},
+		"insecure":        {[]TLSOption{clientCert, WithTLSInsecure()}, true},
+		"server name":     {[]TLSOption{caCert, clientCert, WithTLSServerName("example.com")}, false},
+		"min version":     {[]TLSOption{caCert, clientCert, WithTLSMinVersion(tls.VersionTLS13)}, false},
+		"pinned leaf":     {[]TLSOption{caCert, clientCert, WithTLSPinnedKeys(pin(pki.server))}, true},
+		"pinned ca":       {[]TLSOption{caCert, clientCert, WithTLSPinnedKeys("sha256//" + pin(pki.ca))}, true},
+		"not pinned":      {[]TLSOption{caCert, clientCert, WithTLSPinnedKeys(pin(pki.client))}, false},
+		"insecure pinned": {[]TLSOption{clientCert, WithTLSInsecure(), WithTLSPinnedKeys(pin(pki.server))}, true},
+		"insecure ca pin": {[]TLSOption{clientCert, WithTLSInsecure(), WithTLSPinnedKeys(pin(pki.ca))}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := NewTLSConfig(append([]TLSOption{WithTLSServerName("localhost")}, run.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tlsHandshake(pki.serverConfig(), config); (err == nil) != run.ok {
+				t.Fatalf("handshake error = %v, want ok = %t", err, run.ok)
+			}
+		})
+	}
+
+	if _, err = NewTLSConfig(WithTLSPKCS12(p12, "wrong")); err == nil {
+		t.Error("wrong PKCS#12 password accepted")
+	}
+	if _, err = NewTLSConfig(WithTLSPinnedKeys("sha256//bad")); err == nil {
+		t.Error("malformed pinned key accepted")
+	}
+}
+
+// tlsHandshake performs TLS 1.2 handshake where client
+// certificates are verified before it's complete.
+func tlsHandshake(serverConfig, clientConfig *tls.Config) error {
+	serverConfig.MaxVersion = tls.VersionTLS12
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+	defer func() { <-done }()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// testPKI is a certificate authority with server and client
+// certificates issued by it and stored as PEM files.
+type testPKI struct {
+	t   *testing.T
+	dir string
+
+	ca, server, client          *x509.Certificate
+	caKey, serverKey, clientKey *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mqtt-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{t: t, dir: dir}
+	p.ca, p.caKey = p.issue("ca", &x509.Certificate{
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	p.server, p.serverKey = p.issue("server", &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, p.ca, p.caKey)
+	p.client, p.clientKey = p.issue("client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, p.ca, p.caKey)
+	return p
+}
+
+func (p *testPKI) issue(
+	name string, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	p.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.write(name+".pem", &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	p.write(name+".key", &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, key
+}
+
+func (p *testPKI) write(name string, block *pem.Block) {
+	p.t.Helper()
+	if err := ioutil.WriteFile(p.path(name), pem.EncodeToMemory(block), 0600); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// serverConfig requires clients to present certificates issued by the CA.
+func (p *testPKI) serverConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{p.server.Raw},
+			PrivateKey:  p.serverKey,
+		}},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+}
+
+func (p *testPKI) Close() {
+	os.RemoveAll(p.dir)
+}
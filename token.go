@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// PublishAsync sends the message and returns a token that is completed
+// when the QoS flow is done, that is when PUBACK or PUBCOMP is received,
+// right after sending QoS 0 messages or when it fails, so the caller
+// can have multiple messages in flight at once.
+//
+// It returns after the message is passed to the transmitter,
+// so messages published one after another are sent in the same order.
+// The context limits the whole flow including waiting for acknowledgements.
+//
+// Messages put into the offline queue complete tokens once they're
+// published after reconnect or with ErrQueueFull when they're dropped.
+func (c *Client) PublishAsync(
+	ctx context.Context, topic string, opts ...packet.PublishOption,
+) *Token {
+	t := &Token{done: make(chan struct{})}
+	queued := make(chan error, 1)
+	publish, ackc, err := c.publish(ctx, func(err error) {
+		queued <- err
+	}, topic, opts...)
+	var errc <-chan error
+	switch {
+	case err != nil:
+		t.complete(err)
+		return t
+	case publish == nil:
+		errc = queued
+	case ackc == nil:
+		t.complete(nil)
+		return t
+	default:
+		errc = c.finish(publish, ackc)
+	}
+	go func() {
+		select {
+		case err := <-errc:
+			t.complete(err)
+		case <-ctx.Done():
+			// the flow goes on in the background
+			t.complete(ctx.Err())
+		}
+	}()
+	return t
+}
+
+// Token is the result of an asynchronous operation.
+type Token struct {
+	mu        sync.Mutex
+	done      chan struct{}
+	err       error
+	callbacks []func(err error)
+}
+
+// Done returns a channel that is closed when the operation is complete.
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns the result of the operation, it's nil until it's complete.
+func (t *Token) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Wait waits for the operation to complete and returns its result.
+func (t *Token) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnDone calls fn with the result when the operation is complete,
+// it's called right away when it's complete already.
+// Callbacks must not block because they're called one after another.
+func (t *Token) OnDone(fn func(err error)) {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		err := t.err
+		t.mu.Unlock()
+		fn(err)
+	default:
+		t.callbacks = append(t.callbacks, fn)
+		t.mu.Unlock()
+	}
+}
+
+func (t *Token) complete(err error) {
+	t.mu.Lock()
+	t.err = err
+	close(t.done)
+	callbacks := t.callbacks
+	t.callbacks = nil
+	t.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(err)
+	}
+}
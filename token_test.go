@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestPublishAsync(t *testing.T) {
+	c, s := newPipeClient(t)
+	defer c.Close()
+
+	// messages are sent in order without waiting for acknowledgements
+	var tokens []*Token
+	for i := 1; i <= 3; i++ {
+		done := make(chan *Token, 1)
+		go func(i int) {
+			done <- c.PublishAsync(context.Background(), "a",
+				packet.WithPublishQoS(packet.QoS1),
+				packet.WithPublishPacketID(uint16(i)),
+			)
+		}(i)
+		publish, ok := s.recv().(*packet.Publish)
+		if !ok || publish.PacketID != uint16(i) {
+			t.Fatalf("publish %d expected, got %v", i, publish)
+		}
+		tokens = append(tokens, <-done)
+	}
+
+	errc := make(chan error, 1)
+	tokens[2].OnDone(func(err error) {
+		errc <- err
+	})
+	for _, tok := range tokens {
+		select {
+		case <-tok.Done():
+			t.Fatal("token is done before the acknowledgement")
+		default:
+		}
+	}
+	for i := 3; i >= 1; i-- {
+		s.send(packet.NewPuback(uint16(i)))
+	}
+	for _, tok := range tokens {
+		if err := tok.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// callbacks of complete tokens are called right away
+	tok := c.PublishAsync(context.Background(), "a/+")
+	tok.OnDone(func(err error) {
+		errc <- err
+	})
+	if err := <-errc; err == nil || err != tok.Err() {
+		t.Fatalf("err = %v, want invalid topic error", err)
+	}
+}
+
+func TestPublishAsyncQueued(t *testing.T) {
+	q, err := NewQueue(1, WithQueuePolicy(OverflowDropOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make(chan *fakeServer, 1)
+	c := NewWithDialer(DialFunc(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cc, sc := net.Pipe()
+		servers <- &fakeServer{t: t, conn: sc, enc: NewEncoder(sc), dec: NewServerDecoder(sc)}
+		return cc, nil
+	}), WithOfflineQueue(q))
+	defer c.Close()
+
+	// the first message is dropped to make space for the second one
+	tokens := make([]*Token, 2)
+	for i := range tokens {
+		tokens[i] = c.PublishAsync(context.Background(), "a", packet.WithPublishQoS(packet.QoS1))
+	}
+	if err = tokens[0].Wait(context.Background()); err != ErrQueueFull {
+		t.Fatalf("err = %v, want %v", err, ErrQueueFull)
+	}
+	select {
+	case <-tokens[1].Done():
+		t.Fatal("queued message token is done before it's sent")
+	default:
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Connect(context.Background())
+		errc <- err
+	}()
+	s := <-servers
+	s.expectConnect()
+	s.send(packet.NewConnack())
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	publish, ok := s.recv().(*packet.Publish)
+	if !ok {
+		t.Fatalf("publish expected, got %v", publish)
+	}
+	select {
+	case <-tokens[1].Done():
+		t.Fatal("token is done before the acknowledgement")
+	default:
+	}
+	s.send(packet.NewPuback(publish.PacketID))
+	if err = tokens[1].Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
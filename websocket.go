@@ -0,0 +1,310 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WebSocket opcodes, RFC 6455 §5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errWebSocketClosed = errors.New("websocket: connection is closed")
+
+// DialWebSocket connects to the ws or wss URL and returns a connection that
+// can be passed to New, config is used for wss and can be nil.
+func DialWebSocket(ctx context.Context, rawurl string, config *tls.Config) (*WebSocket, error) {
+	d, err := newURLDialer(rawurl, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !d.ws {
+		return nil, fmt.Errorf("%s: not a websocket url", rawurl)
+	}
+	rw, err := d.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rw.(*WebSocket), nil
+}
+
+// NewWebSocket performs the RFC 6455 opening handshake with the "mqtt"
+// subprotocol over the established connection, header is added to
+// the upgrade request and can be nil.
+//
+// MQTT packets are sent in binary frames, fragmented messages are
+// reassembled and server pings are answered transparently.
+func NewWebSocket(ctx context.Context, conn net.Conn, u *url.URL, header http.Header) (*WebSocket, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Opaque: u.RequestURI()},
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header, len(header)+5),
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "mqtt")
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("websocket handshake failed: %s", res.Status)
+	case !strings.EqualFold(res.Header.Get("Upgrade"), "websocket"),
+		!headerContains(res.Header, "Connection", "upgrade"):
+		return nil, errors.New("websocket handshake failed: connection is not upgraded")
+	case res.Header.Get("Sec-WebSocket-Accept") != wsAccept(key):
+		return nil, errors.New("websocket handshake failed: invalid accept key")
+	case res.Header.Get("Sec-WebSocket-Protocol") != "mqtt":
+		return nil, errors.New("websocket handshake failed: mqtt subprotocol is not selected")
+	}
+	return &WebSocket{Conn: conn, r: br, wsem: make(chan struct{}, 1)}, nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocket is a client WebSocket connection that transfers
+// a stream of bytes in binary messages.
+type WebSocket struct {
+	net.Conn
+	r *bufio.Reader
+
+	// reading state, Read is not safe for concurrent use
+	remain     uint64 // unread payload bytes of the current frame
+	mask       [4]byte
+	masked     bool
+	pos        uint64 // payload offset, for unmasking
+	fragmented bool   // the current message is not finished yet
+	rerr       error
+
+	wsem   chan struct{} // write lock that Close doesn't block on
+	closed bool          // close frame is sent, guarded by wsem
+}
+
+// Read reads payload of binary messages.
+func (ws *WebSocket) Read(b []byte) (int, error) {
+	if ws.rerr != nil {
+		return 0, ws.rerr
+	}
+	for ws.remain == 0 {
+		if err := ws.next(); err != nil {
+			ws.rerr = err
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > ws.remain {
+		b = b[:ws.remain]
+	}
+	n, err := ws.r.Read(b)
+	if ws.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= ws.mask[(ws.pos+uint64(i))%4]
+		}
+	}
+	ws.remain -= uint64(n)
+	ws.pos += uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		ws.rerr = err
+	}
+	return n, err
+}
+
+// next reads frame headers and handles control frames
+// until a data frame with non-empty payload is found.
+func (ws *WebSocket) next() error {
+	var h [2]byte
+	if _, err := io.ReadFull(ws.r, h[:]); err != nil {
+		return err
+	}
+	fin, opcode := h[0]&0x80 != 0, h[0]&0x0f
+	if h[0]&0x70 != 0 {
+		return errors.New("websocket: reserved bits are set")
+	}
+	ws.masked = h[1]&0x80 != 0
+	size := uint64(h[1] & 0x7f)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+	if ws.masked {
+		// servers must not mask frames, but it costs nothing to accept them
+		if _, err := io.ReadFull(ws.r, ws.mask[:]); err != nil {
+			return err
+		}
+	}
+	ws.remain, ws.pos = size, 0
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		if (opcode == wsContinuation) != ws.fragmented {
+			return errors.New("websocket: unexpected continuation frame")
+		}
+		ws.fragmented = !fin
+		return nil
+	case wsText:
+		return errors.New("websocket: text frames are not allowed")
+	case wsPing, wsPong, wsClose:
+	default:
+		return fmt.Errorf("websocket: unknown opcode %#x", opcode)
+	}
+
+	if !fin || size > 125 {
+		return errors.New("websocket: malformed control frame")
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(ws, payload); err != nil {
+		return err
+	}
+	switch opcode {
+	case wsPing:
+		return ws.writeFrame(wsPong, payload)
+	case wsClose:
+		ws.wsem <- struct{}{}
+		_ = ws.writeCloseLocked(payload)
+		<-ws.wsem
+		return io.EOF
+	}
+	return nil
+}
+
+// Write sends b in a single binary message.
+func (ws *WebSocket) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends the close frame and closes the underlying connection,
+// the frame is skipped when a write is in progress.
+func (ws *WebSocket) Close() error {
+	select {
+	case ws.wsem <- struct{}{}:
+		var code [2]byte
+		binary.BigEndian.PutUint16(code[:], 1000) // normal closure
+		_ = ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = ws.writeCloseLocked(code[:])
+		<-ws.wsem
+	default:
+	}
+	return ws.Conn.Close()
+}
+
+func (ws *WebSocket) writeCloseLocked(payload []byte) error {
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	return ws.writeFrameLocked(wsClose, payload)
+}
+
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.wsem <- struct{}{}
+	defer func() { <-ws.wsem }()
+	if ws.closed {
+		return errWebSocketClosed
+	}
+	return ws.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes a masked frame as required from clients.
+func (ws *WebSocket) writeFrameLocked(opcode byte, payload []byte) error {
+	buf := make([]byte, 2, 14+len(payload))
+	buf[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		buf[1] = 0x80 | byte(n)
+	case n <= 0xffff:
+		buf[1] = 0x80 | 126
+		buf = append(buf, byte(n>>8), byte(n))
+	default:
+		buf[1] = 0x80 | 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		buf = append(buf, b[:]...)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	for i, c := range payload {
+		buf = append(buf, c^mask[i%4])
+	}
+	_, err := ws.Conn.Write(buf)
+	return err
+}
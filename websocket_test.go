@@ -0,0 +1,174 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestWebSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type result struct {
+		c   *Client
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		c, err := Dial(context.Background(), "ws://"+l.Addr().String()+"/mqtt")
+		resc <- result{c, err}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	s := &wsServer{t: t, conn: conn, r: bufio.NewReader(conn)}
+	s.upgrade("/mqtt")
+
+	opcode, payload := s.readFrame()
+	if opcode != wsBinary {
+		t.Fatalf("opcode = %#x, want binary", opcode)
+	}
+	if _, ok := mustDecode(t, NewServerDecoder(bytes.NewReader(payload))).(*packet.Connect); !ok {
+		t.Fatal("connect expected")
+	}
+
+	// CONNACK fragmented in two frames with a ping in between
+	var b bytes.Buffer
+	if err = NewEncoder(&b).Encode(packet.NewConnack()); err != nil {
+		t.Fatal(err)
+	}
+	s.writeFrame(wsBinary, false, b.Bytes()[:1])
+	s.writeFrame(wsPing, true, []byte("ping"))
+	s.writeFrame(wsContinuation, true, b.Bytes()[1:])
+	if opcode, payload = s.readFrame(); opcode != wsPong || string(payload) != "ping" {
+		t.Fatalf("frame = %#x %q, want pong %q", opcode, payload, "ping")
+	}
+
+	res := <-resc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	res.c.Close()
+	if opcode, payload = s.readFrame(); opcode != wsClose || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Fatalf("frame = %#x %q, want close 1000", opcode, payload)
+	}
+}
+
+func TestWebSocketHandshakeError(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go func() {
+		defer sc.Close()
+		req, err := http.ReadRequest(bufio.NewReader(sc))
+		if err != nil {
+			return
+		}
+		// no subprotocol selected
+		_, _ = io.WriteString(sc, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+wsAccept(req.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n")
+	}()
+	u, _ := newURLDialer("ws://localhost/mqtt", nil, nil)
+	if _, err := NewWebSocket(context.Background(), cc, u.url, nil); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+// wsServer is a minimal WebSocket server side.
+type wsServer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *wsServer) upgrade(path string) {
+	s.t.Helper()
+	req, err := http.ReadRequest(s.r)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if req.URL.Path != path {
+		s.t.Errorf("path = %q, want %q", req.URL.Path, path)
+	}
+	if have := req.Header.Get("Sec-WebSocket-Protocol"); have != "mqtt" {
+		s.t.Errorf("subprotocol = %q, want %q", have, "mqtt")
+	}
+	if _, err = io.WriteString(s.conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: mqtt\r\n"+
+		"Sec-WebSocket-Accept: "+wsAccept(req.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n",
+	); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func (s *wsServer) readFrame() (byte, []byte) {
+	s.t.Helper()
+	var h [2]byte
+	if _, err := io.ReadFull(s.r, h[:]); err != nil {
+		s.t.Fatal(err)
+	}
+	if h[1]&0x80 == 0 {
+		s.t.Fatal("client frames must be masked")
+	}
+	size := int(h[1] & 0x7f)
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(s.r, b[:]); err != nil {
+			s.t.Fatal(err)
+		}
+		size = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		s.t.Fatal("frame is too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(s.r, mask[:]); err != nil {
+		s.t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		s.t.Fatal(err)
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return h[0] & 0x0f, payload
+}
+
+func (s *wsServer) writeFrame(opcode byte, fin bool, payload []byte) {
+	s.t.Helper()
+	h := []byte{opcode, byte(len(payload))}
+	if fin {
+		h[0] |= 0x80
+	}
+	if _, err := s.conn.Write(append(h, payload...)); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func mustDecode(t *testing.T, d *Decoder) packet.IncomingPacket {
+	t.Helper()
+	pk, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
@@ -0,0 +1,138 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithInflightWindow limits the number of QoS 1 and QoS 2 messages
+// that are sent but not acknowledged yet, new publishes wait until
+// acknowledgements free slots. Zero means no limit that is the default.
+//
+// MQTT 5.0 servers limit the window with the receive maximum
+// CONNACK property, in this case the lower limit applies.
+func WithInflightWindow(n int) Option {
+	return func(c *Client) {
+		c.window.max = n
+		c.window.limit = n
+	}
+}
+
+// InflightStats is a snapshot of outgoing messages flow control.
+type InflightStats struct {
+	// InFlight is the number of unacknowledged QoS 1 and QoS 2 messages.
+	InFlight int
+
+	// Limit is the current window size, zero means no limit.
+	Limit int
+
+	// Waiting is the number of publishes waiting for free slots.
+	Waiting int
+
+	// Queued is the number of messages in the offline queue.
+	Queued int
+
+	// Waits is the number of publishes that had to wait for free slots,
+	// WaitTime is the total time they've waited and MaxWait the longest wait.
+	Waits    uint64
+	WaitTime time.Duration
+	MaxWait  time.Duration
+}
+
+// InflightStats returns the current state of the in-flight window.
+func (c *Client) InflightStats() InflightStats {
+	c.window.mu.Lock()
+	stats := c.window.stats
+	stats.InFlight = c.window.used
+	stats.Limit = c.window.limit
+	c.window.mu.Unlock()
+	if c.queue != nil {
+		stats.Queued = c.queue.Len()
+	}
+	return stats
+}
+
+// window is a semaphore with adjustable capacity.
+type window struct {
+	mu      sync.Mutex
+	max     int // configured limit
+	limit   int // effective limit
+	used    int
+	stats   InflightStats
+	changed chan struct{} // closed and replaced when slots are freed or the limit grows
+}
+
+func newWindow() *window {
+	return &window{changed: make(chan struct{})}
+}
+
+func (w *window) notify() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// setReceiveMaximum applies the limit requested by the server,
+// zero means the server doesn't limit the window.
+func (w *window) setReceiveMaximum(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limit = w.max
+	if n != 0 && (w.limit == 0 || n < w.limit) {
+		w.limit = n
+	}
+	w.notify()
+}
+
+// acquire takes a slot waiting for one when the window is full.
+func (w *window) acquire(ctx context.Context, done <-chan struct{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.limit == 0 || w.used < w.limit {
+		w.used++
+		return nil
+	}
+
+	start := time.Now()
+	w.stats.Waiting++
+	defer func() {
+		d := time.Since(start)
+		w.stats.Waiting--
+		w.stats.Waits++
+		w.stats.WaitTime += d
+		if d > w.stats.MaxWait {
+			w.stats.MaxWait = d
+		}
+	}()
+	for w.limit != 0 && w.used >= w.limit {
+		changed := w.changed
+		w.mu.Unlock()
+		select {
+		case <-changed:
+			w.mu.Lock()
+		case <-done:
+			w.mu.Lock()
+			return errClosed
+		case <-ctx.Done():
+			w.mu.Lock()
+			return ctx.Err()
+		}
+	}
+	w.used++
+	return nil
+}
+
+// take takes a slot regardless of the limit,
+// it's used for messages that are already in flight.
+func (w *window) take() {
+	w.mu.Lock()
+	w.used++
+	w.mu.Unlock()
+}
+
+func (w *window) release() {
+	w.mu.Lock()
+	w.used--
+	w.notify()
+	w.mu.Unlock()
+}
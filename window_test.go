@@ -0,0 +1,67 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestInflightWindow(t *testing.T) {
+	c, s := newPipeClient(t, WithInflightWindow(2))
+	defer c.Close()
+
+	// the server lowers the window
+	s.dec.SetProtocolLevel(packet.ProtocolLevel5)
+	s.enc.SetProtocolLevel(packet.ProtocolLevel5)
+	connect(t, c, s, packet.NewConnack(packet.WithConnackProperties(packet.Properties{
+		ReceiveMaximum: packet.Uint16(1),
+	})), packet.WithConnectProtocolLevel(packet.ProtocolLevel5))
+
+	tokc := make(chan *Token, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			tokc <- c.PublishAsync(context.Background(), "a",
+				packet.WithPublishQoS(packet.QoS1),
+				packet.WithPublishPacketID(uint16(i)),
+			)
+		}(i)
+	}
+	first, ok := s.recv().(*packet.Publish)
+	if !ok {
+		t.Fatal("publish expected")
+	}
+	tok := <-tokc
+
+	// the second one waits for the first to be acknowledged
+	for i := 0; c.InflightStats().Waiting != 1; i++ {
+		if i == 100 {
+			t.Fatal("publish is not waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := c.InflightStats(); stats.InFlight != 1 || stats.Limit != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.send(packet.NewPuback(first.PacketID))
+	if err := tok.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	second, ok := s.recv().(*packet.Publish)
+	if !ok || second.PacketID == first.PacketID {
+		t.Fatal("second publish expected")
+	}
+	tok = <-tokc
+	s.send(packet.NewPuback(second.PacketID))
+	if err := tok.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := c.InflightStats()
+	if stats.InFlight != 0 || stats.Waits != 1 || stats.MaxWait < 10*time.Millisecond ||
+		stats.WaitTime != stats.MaxWait {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"context"
+	"hash/fnv"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+// ContextMessagesHandler is a messages handler that receives a context
+// that is cancelled when the client is closed or the handler returns.
+type ContextMessagesHandler func(ctx context.Context, publish *packet.Publish)
+
+// WithContextMessagesHandler sets the handler of messages that match
+// no router filters, it's used instead of the WithMessagesHandler one.
+func WithContextMessagesHandler(handler ContextMessagesHandler) Option {
+	return func(c *Client) {
+		c.ctxHandler = handler
+	}
+}
+
+// WorkerOption is a worker pool configuration option.
+type WorkerOption func(p *workerPool)
+
+// WithWorkerKey sets the function that returns the ordering key of messages,
+// messages with the same key are handled by the same worker one by one
+// in the order they're received, the key is the topic name by default.
+func WithWorkerKey(fn func(publish *packet.Publish) string) WorkerOption {
+	return func(p *workerPool) {
+		p.key = fn
+	}
+}
+
+// WithWorkerQueueSize sets the number of messages waiting for every worker,
+// receiving packets is blocked when the queue of a worker is full.
+func WithWorkerQueueSize(n int) WorkerOption {
+	return func(p *workerPool) {
+		p.size = n
+	}
+}
+
+// WithWorkers makes the client handle incoming messages with n workers
+// instead of the goroutine reading from the connection, so slow handlers
+// don't delay acknowledgements and other packets.
+//
+// Messages are acknowledged as soon as they're passed to a worker.
+func WithWorkers(n int, opts ...WorkerOption) Option {
+	return func(c *Client) {
+		if n < 1 {
+			n = 1
+		}
+		p := &workerPool{size: 64}
+		for _, opt := range opts {
+			opt(p)
+		}
+		p.queues = make([]chan *packet.Publish, n)
+		for i := range p.queues {
+			p.queues[i] = make(chan *packet.Publish, p.size)
+		}
+		c.workers = p
+	}
+}
+
+type workerPool struct {
+	queues []chan *packet.Publish
+	key    func(publish *packet.Publish) string
+	size   int
+}
+
+// startWorkers starts workers that stop when the client is closed.
+func (c *Client) startWorkers() {
+	for _, q := range c.workers.queues {
+		go func(q <-chan *packet.Publish) {
+			for {
+				select {
+				case publish := <-q:
+					c.dispatch(publish)
+				case <-c.done:
+					return
+				}
+			}
+		}(q)
+	}
+}
+
+// enqueueWork passes the message to the worker its key is assigned to.
+func (c *Client) enqueueWork(publish *packet.Publish) {
+	key := publish.Topic
+	if c.workers.key != nil {
+		key = c.workers.key(publish)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q := c.workers.queues[h.Sum32()%uint32(len(c.workers.queues))]
+
+	// the decoder reuses its buffer once the packet is handled
+	publish = copyPublish(publish)
+	select {
+	case q <- publish:
+	case <-c.done:
+	}
+}
@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/mqtt/packet"
+)
+
+func TestWorkers(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]int{}
+	unblock := make(chan struct{})
+	cancelled := make(chan struct{})
+	c, s := newPipeClient(t,
+		WithWorkers(2, WithWorkerKey(func(publish *packet.Publish) string {
+			return publish.Topic[:1] // a/1 and a/2 are ordered together
+		})),
+		WithContextMessagesHandler(func(ctx context.Context, publish *packet.Publish) {
+			switch publish.Topic {
+			case "block":
+				// the reader is not blocked by the handler
+				<-unblock
+				return
+			case "wait":
+				<-ctx.Done()
+				close(cancelled)
+				return
+			}
+			mu.Lock()
+			received[publish.Topic[:1]] = append(received[publish.Topic[:1]], int(publish.Payload[0]))
+			mu.Unlock()
+		}),
+	)
+	defer c.Close()
+
+	s.send(packet.NewPublish("block"))
+	for i := 0; i < 10; i++ {
+		s.send(packet.NewPublish(fmt.Sprintf("a/%d", i%2), packet.WithPublishPayload([]byte{byte(i)})))
+	}
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	close(unblock)
+
+	want := map[string][]int{"a": {0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}
+	for i := 0; ; i++ {
+		mu.Lock()
+		ok := reflect.DeepEqual(received, want)
+		mu.Unlock()
+		if ok {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("received = %v, want %v", received, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.send(packet.NewPublish("wait"))
+	if err := ping(c, s); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context is not cancelled")
+	}
+}